@@ -0,0 +1,86 @@
+package dynamic
+
+import (
+	"os"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// MessageFactory resolves a fully-qualified message or enum type name (as
+// left in a resolved FieldDescriptorProto.TypeName by parser.Resolve) to
+// the descriptor that describes it, so a Message can construct the right
+// kind of nested Message for a message- or group-typed field, or look up
+// an enum value's name or number, without carrying around a copy of every
+// type in the file set itself.
+type MessageFactory struct {
+	byName     map[string]*DescriptorProto
+	enumByName map[string]*EnumDescriptorProto
+
+	// isProto3 records, for every message indexed above, whether it came
+	// from a file declaring syntax = "proto3" (Marshal consults this for
+	// a repeated scalar field's default packing; see isPacked).
+	isProto3 map[*DescriptorProto]bool
+}
+
+// NewMessageFactory indexes every message and enum in fds, top-level and
+// nested, under its fully-qualified ("."-prefixed) name. fds is normally
+// the output of parser.ParseFiles followed by parser.Resolve; if it
+// hasn't been through Resolve, TypeName references won't be
+// fully-qualified and lookups against them will fail.
+func NewMessageFactory(fds *FileDescriptorSet) *MessageFactory {
+	mf := &MessageFactory{
+		byName:     make(map[string]*DescriptorProto),
+		enumByName: make(map[string]*EnumDescriptorProto),
+		isProto3:   make(map[*DescriptorProto]bool),
+	}
+	for _, f := range fds.File {
+		root := ""
+		if f.Package != nil {
+			root = "." + f.GetPackage()
+		}
+		isProto3 := f.GetSyntax() == "proto3"
+		for _, msg := range f.MessageType {
+			mf.index(root, msg, isProto3)
+		}
+		for _, enum := range f.EnumType {
+			mf.indexEnum(root, enum)
+		}
+	}
+	return mf
+}
+
+func (mf *MessageFactory) index(scope string, msg *DescriptorProto, isProto3 bool) {
+	fq := scope + "." + msg.GetName()
+	mf.byName[fq] = msg
+	mf.isProto3[msg] = isProto3
+	for _, nested := range msg.NestedType {
+		mf.index(fq, nested, isProto3)
+	}
+	for _, enum := range msg.EnumType {
+		mf.indexEnum(fq, enum)
+	}
+}
+
+func (mf *MessageFactory) indexEnum(scope string, enum *EnumDescriptorProto) {
+	mf.enumByName[scope+"."+enum.GetName()] = enum
+}
+
+// NewMessage constructs an empty Message for the fully-qualified message
+// name fqName (e.g. ".foo.Bar").
+func (mf *MessageFactory) NewMessage(fqName string) (*Message, os.Error) {
+	desc, ok := mf.byName[fqName]
+	if !ok {
+		return nil, os.NewError("dynamic: unknown message type " + fqName)
+	}
+	return NewMessage(desc, mf), nil
+}
+
+// Enum returns the EnumDescriptorProto for the fully-qualified enum type
+// name fqName (e.g. ".foo.Color").
+func (mf *MessageFactory) Enum(fqName string) (*EnumDescriptorProto, os.Error) {
+	enum, ok := mf.enumByName[fqName]
+	if !ok {
+		return nil, os.NewError("dynamic: unknown enum type " + fqName)
+	}
+	return enum, nil
+}
@@ -0,0 +1,404 @@
+package dynamic
+
+import (
+	"math"
+	"os"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// Marshal implements proto.Marshaler by encoding m's fields to wire
+// format, walking m.desc.Field in declaration order and skipping any
+// field with no stored value, just as protoc does for an unset optional
+// field. Bytes captured from fields Unmarshal didn't recognize are
+// appended verbatim afterward.
+func (m *Message) Marshal() ([]byte, os.Error) {
+	var buf []byte
+	for _, f := range m.desc.Field {
+		v, ok := m.fields[f.GetNumber()]
+		if !ok {
+			continue
+		}
+		var err os.Error
+		buf, err = m.appendField(buf, f, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, m.unknown...), nil
+}
+
+func (m *Message) appendField(buf []byte, f *FieldDescriptorProto, v interface{}) ([]byte, os.Error) {
+	if f.GetLabel() != FieldDescriptorProto_LABEL_REPEATED {
+		return m.appendValue(buf, f, v)
+	}
+
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, os.NewError("dynamic: repeated field " + f.GetName() + " must be set as []interface{}")
+	}
+	if m.isPacked(f) && isPackable(f) {
+		return m.appendPacked(buf, f, vals)
+	}
+	for _, elem := range vals {
+		var err os.Error
+		buf, err = m.appendValue(buf, f, elem)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// isPacked reports whether f should be packed-encoded: either it was
+// declared with "[packed = true]", or it has no explicit packed setting
+// and m's file used proto3, where repeated scalar fields are packed by
+// default.
+func (m *Message) isPacked(f *FieldDescriptorProto) bool {
+	if f.Options != nil && f.Options.Packed != nil {
+		return f.Options.GetPacked()
+	}
+	return m.isProto3
+}
+
+// isPackable reports whether f's type is eligible for packed encoding:
+// any scalar numeric, bool or enum type, but not string, bytes, message
+// or group.
+func isPackable(f *FieldDescriptorProto) bool {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_STRING, FieldDescriptorProto_TYPE_BYTES,
+		FieldDescriptorProto_TYPE_MESSAGE, FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	return true
+}
+
+func (m *Message) appendPacked(buf []byte, f *FieldDescriptorProto, vals []interface{}) ([]byte, os.Error) {
+	var packed []byte
+	for _, elem := range vals {
+		var err os.Error
+		packed, err = appendScalar(packed, f, elem)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf = appendTag(buf, f.GetNumber(), wireBytes)
+	buf = appendVarint(buf, uint64(len(packed)))
+	return append(buf, packed...), nil
+}
+
+func (m *Message) appendValue(buf []byte, f *FieldDescriptorProto, v interface{}) ([]byte, os.Error) {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_MESSAGE:
+		nested, ok := v.(*Message)
+		if !ok {
+			return nil, os.NewError("dynamic: field " + f.GetName() + " must be set as *dynamic.Message")
+		}
+		enc, err := nested.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendTag(buf, f.GetNumber(), wireBytes)
+		buf = appendVarint(buf, uint64(len(enc)))
+		return append(buf, enc...), nil
+	case FieldDescriptorProto_TYPE_GROUP:
+		nested, ok := v.(*Message)
+		if !ok {
+			return nil, os.NewError("dynamic: field " + f.GetName() + " must be set as *dynamic.Message")
+		}
+		buf = appendTag(buf, f.GetNumber(), wireStartGroup)
+		enc, err := nested.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, enc...)
+		return appendTag(buf, f.GetNumber(), wireEndGroup), nil
+	}
+
+	buf = appendTag(buf, f.GetNumber(), wireTypeOf(f))
+	return appendScalar(buf, f, v)
+}
+
+func wireTypeOf(f *FieldDescriptorProto) int {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_FIXED64, FieldDescriptorProto_TYPE_SFIXED64, FieldDescriptorProto_TYPE_DOUBLE:
+		return wireFixed64
+	case FieldDescriptorProto_TYPE_STRING, FieldDescriptorProto_TYPE_BYTES:
+		return wireBytes
+	case FieldDescriptorProto_TYPE_FIXED32, FieldDescriptorProto_TYPE_SFIXED32, FieldDescriptorProto_TYPE_FLOAT:
+		return wireFixed32
+	}
+	return wireVarint
+}
+
+// appendScalar encodes a single non-message, non-group field value
+// according to f's declared type. It is shared between ordinary and
+// packed-repeated encoding; v's expected Go type for each
+// FieldDescriptorProto_Type is documented on readScalar, its counterpart.
+func appendScalar(buf []byte, f *FieldDescriptorProto, v interface{}) ([]byte, os.Error) {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_DOUBLE:
+		return appendFixed64(buf, math.Float64bits(v.(float64))), nil
+	case FieldDescriptorProto_TYPE_FLOAT:
+		return appendFixed32(buf, math.Float32bits(v.(float32))), nil
+	case FieldDescriptorProto_TYPE_INT64:
+		return appendVarint(buf, uint64(v.(int64))), nil
+	case FieldDescriptorProto_TYPE_UINT64:
+		return appendVarint(buf, v.(uint64)), nil
+	case FieldDescriptorProto_TYPE_INT32:
+		return appendVarint(buf, uint64(int64(v.(int32)))), nil
+	case FieldDescriptorProto_TYPE_UINT32:
+		return appendVarint(buf, uint64(v.(uint32))), nil
+	case FieldDescriptorProto_TYPE_FIXED64:
+		return appendFixed64(buf, v.(uint64)), nil
+	case FieldDescriptorProto_TYPE_SFIXED64:
+		return appendFixed64(buf, uint64(v.(int64))), nil
+	case FieldDescriptorProto_TYPE_FIXED32:
+		return appendFixed32(buf, v.(uint32)), nil
+	case FieldDescriptorProto_TYPE_SFIXED32:
+		return appendFixed32(buf, uint32(v.(int32))), nil
+	case FieldDescriptorProto_TYPE_BOOL:
+		if v.(bool) {
+			return appendVarint(buf, 1), nil
+		}
+		return appendVarint(buf, 0), nil
+	case FieldDescriptorProto_TYPE_STRING:
+		s := v.(string)
+		buf = appendVarint(buf, uint64(len(s)))
+		return append(buf, s...), nil
+	case FieldDescriptorProto_TYPE_BYTES:
+		b := v.([]byte)
+		buf = appendVarint(buf, uint64(len(b)))
+		return append(buf, b...), nil
+	case FieldDescriptorProto_TYPE_SINT32:
+		return appendVarint(buf, uint64(zigzagEncode32(v.(int32)))), nil
+	case FieldDescriptorProto_TYPE_SINT64:
+		return appendVarint(buf, zigzagEncode64(v.(int64))), nil
+	case FieldDescriptorProto_TYPE_ENUM:
+		return appendVarint(buf, uint64(int64(v.(int32)))), nil
+	}
+	return nil, os.NewError("dynamic: unsupported field type for " + f.GetName())
+}
+
+// Unmarshal implements proto.Unmarshaler by decoding buf into m, replacing
+// any values m already held. Fields not present in m's descriptor are
+// kept as raw bytes in m.unknown rather than rejected, so re-marshaling a
+// message built from an older .proto still round-trips newer data.
+func (m *Message) Unmarshal(buf []byte) os.Error {
+	m.fields = make(map[int32]interface{})
+	m.unknown = nil
+
+	r := &reader{buf: buf}
+	for !r.done() {
+		start := r.i
+		tag, err := r.readVarint()
+		if err != nil {
+			return err
+		}
+		num := int32(tag >> 3)
+		wireType := int(tag & 7)
+
+		f := m.fieldByNumber(num)
+		if f == nil || !wireTypeMatches(f, wireType) {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+			m.unknown = append(m.unknown, buf[start:r.i]...)
+			continue
+		}
+		if err := m.readField(r, f, wireType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wireTypeMatches reports whether wireType is a valid encoding of f on the
+// wire: the one wireTypeOf(f) (or, for message/group fields, wireBytes /
+// wireStartGroup) declares, or, for a packable repeated scalar field,
+// either that or wireBytes, since such a field may arrive packed or
+// unpacked regardless of how it was declared. A mismatch (for example an
+// int32 field arriving as wireBytes) is treated the same as an unknown
+// field: the schema cannot be trusted to decode it, so it's captured into
+// m.unknown instead of misread.
+func wireTypeMatches(f *FieldDescriptorProto, wireType int) bool {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_MESSAGE:
+		return wireType == wireBytes
+	case FieldDescriptorProto_TYPE_GROUP:
+		return wireType == wireStartGroup
+	}
+	if wireType == wireTypeOf(f) {
+		return true
+	}
+	return f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED && wireType == wireBytes && isPackable(f)
+}
+
+func (m *Message) readField(r *reader, f *FieldDescriptorProto, wireType int) os.Error {
+	if f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED && wireType == wireBytes && isPackable(f) {
+		payload, err := r.readBytes()
+		if err != nil {
+			return err
+		}
+		sub := &reader{buf: payload}
+		for !sub.done() {
+			v, err := readScalar(sub, f)
+			if err != nil {
+				return err
+			}
+			m.appendRepeated(f.GetNumber(), v)
+		}
+		return nil
+	}
+
+	v, err := m.readValue(r, f, wireType)
+	if err != nil {
+		return err
+	}
+	m.setOrAppend(f, v)
+	return nil
+}
+
+func (m *Message) readValue(r *reader, f *FieldDescriptorProto, wireType int) (interface{}, os.Error) {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_MESSAGE:
+		payload, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		nested, err := m.newNested(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := nested.Unmarshal(payload); err != nil {
+			return nil, err
+		}
+		return nested, nil
+	case FieldDescriptorProto_TYPE_GROUP:
+		nested, err := m.newNested(f)
+		if err != nil {
+			return nil, err
+		}
+		// A group's contents are an ordinary sequence of tag/value pairs
+		// with no length prefix, terminated by the matching end-group
+		// tag, so its bytes must be collected field by field rather than
+		// read as one length-delimited chunk.
+		var body []byte
+		for {
+			tagStart := r.i
+			tag, err := r.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			wt := int(tag & 7)
+			if wt == wireEndGroup {
+				break
+			}
+			if err := r.skip(wt); err != nil {
+				return nil, err
+			}
+			body = append(body, r.buf[tagStart:r.i]...)
+		}
+		if err := nested.Unmarshal(body); err != nil {
+			return nil, err
+		}
+		return nested, nil
+	}
+	return readScalar(r, f)
+}
+
+// readScalar decodes a single non-message, non-group field value
+// according to f's declared type, returning it as the Go type Get and
+// MarshalText expect for that FieldDescriptorProto_Type: float64/float32
+// for DOUBLE/FLOAT, int32/int64/uint32/uint64 for the various integer
+// types (signed ones sign-extended, not zero-extended), bool, string, or
+// []byte.
+func readScalar(r *reader, f *FieldDescriptorProto) (interface{}, os.Error) {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_DOUBLE:
+		v, err := r.readFixed64()
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(v), nil
+	case FieldDescriptorProto_TYPE_FLOAT:
+		v, err := r.readFixed32()
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(v), nil
+	case FieldDescriptorProto_TYPE_INT64:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case FieldDescriptorProto_TYPE_UINT64:
+		return r.readVarint()
+	case FieldDescriptorProto_TYPE_INT32:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return int32(v), nil
+	case FieldDescriptorProto_TYPE_UINT32:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return uint32(v), nil
+	case FieldDescriptorProto_TYPE_FIXED64:
+		return r.readFixed64()
+	case FieldDescriptorProto_TYPE_SFIXED64:
+		v, err := r.readFixed64()
+		if err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case FieldDescriptorProto_TYPE_FIXED32:
+		return r.readFixed32()
+	case FieldDescriptorProto_TYPE_SFIXED32:
+		v, err := r.readFixed32()
+		if err != nil {
+			return nil, err
+		}
+		return int32(v), nil
+	case FieldDescriptorProto_TYPE_BOOL:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return v != 0, nil
+	case FieldDescriptorProto_TYPE_STRING:
+		b, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case FieldDescriptorProto_TYPE_BYTES:
+		b, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case FieldDescriptorProto_TYPE_SINT32:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return zigzagDecode32(uint32(v)), nil
+	case FieldDescriptorProto_TYPE_SINT64:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return zigzagDecode64(v), nil
+	case FieldDescriptorProto_TYPE_ENUM:
+		v, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		return int32(v), nil
+	}
+	return nil, os.NewError("dynamic: unsupported field type for " + f.GetName())
+}
@@ -0,0 +1,152 @@
+// Package dynamic implements reflection-based protocol buffer messages
+// built directly from a DescriptorProto produced by the parser package,
+// with no generated Go type. It is analogous to jhump/protoreflect's
+// dynamic messages: a Message can be marshaled, unmarshaled and
+// round-tripped through text format purely from its descriptor.
+package dynamic
+
+import (
+	"os"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// Message is a reflection-based implementation of a protocol buffer
+// message. It holds field values in a map keyed by field number rather
+// than in generated struct fields, and implements proto.Marshaler and
+// proto.Unmarshaler (see marshal.go) so it can stand in anywhere a
+// generated message would.
+type Message struct {
+	desc *DescriptorProto
+	mf   *MessageFactory // resolves nested message types; may be nil
+
+	// isProto3 records whether desc came from a file declaring
+	// syntax = "proto3", which changes Marshal's default for whether a
+	// repeated scalar field is packed (see isPacked in marshal.go). It is
+	// known only when mf is non-nil and has indexed desc.
+	isProto3 bool
+
+	// fields holds one entry per set field, keyed by field number. A
+	// singular field's value is the Go type matching its declared
+	// FieldDescriptorProto_Type (see readScalar in marshal.go); a
+	// repeated field's value is always []interface{}.
+	fields map[int32]interface{}
+
+	// unknown holds the raw wire-format bytes of any fields not present
+	// in desc, kept verbatim so re-marshaling a message round-trips data
+	// it didn't understand, the same courtesy generated messages give
+	// unrecognized fields.
+	unknown []byte
+}
+
+// NewMessage creates an empty Message for desc. mf is used to look up the
+// descriptor of any message- or group-typed field when unmarshaling or
+// reading text format; it may be nil if desc has no such fields, or the
+// caller always supplies nested *Message values itself via Set.
+func NewMessage(desc *DescriptorProto, mf *MessageFactory) *Message {
+	m := &Message{desc: desc, mf: mf, fields: make(map[int32]interface{})}
+	if mf != nil {
+		m.isProto3 = mf.isProto3[desc]
+	}
+	return m
+}
+
+// Descriptor returns the message's descriptor.
+func (m *Message) Descriptor() *DescriptorProto {
+	return m.desc
+}
+
+// Get returns the value stored for field number num, and whether it was
+// set at all. A repeated field's value is a []interface{}.
+func (m *Message) Get(num int32) (interface{}, bool) {
+	v, ok := m.fields[num]
+	return v, ok
+}
+
+// Set stores v as the value of field number num, replacing any previous
+// value. No validation is done against the field's declared type; it is
+// the caller's responsibility to pass a value Marshal knows how to encode
+// for that field (see appendScalar in marshal.go for the expected Go type
+// of each FieldDescriptorProto_Type).
+func (m *Message) Set(num int32, v interface{}) {
+	m.fields[num] = v
+}
+
+// fieldByNumber returns the FieldDescriptorProto for field number num, or
+// nil if the message's descriptor has no such field.
+func (m *Message) fieldByNumber(num int32) *FieldDescriptorProto {
+	for _, f := range m.desc.Field {
+		if f.GetNumber() == num {
+			return f
+		}
+	}
+	return nil
+}
+
+// fieldByName returns the FieldDescriptorProto named name, or nil if the
+// message's descriptor has no such field. Used by the text format reader,
+// which addresses fields by name rather than number.
+func (m *Message) fieldByName(name string) *FieldDescriptorProto {
+	for _, f := range m.desc.Field {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// appendRepeated appends v to the []interface{} stored for field number
+// num, creating it if this is the field's first value.
+func (m *Message) appendRepeated(num int32, v interface{}) {
+	existing, _ := m.fields[num].([]interface{})
+	m.fields[num] = append(existing, v)
+}
+
+// setOrAppend stores v as f's value, appending rather than replacing if f
+// is repeated.
+func (m *Message) setOrAppend(f *FieldDescriptorProto, v interface{}) {
+	if f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED {
+		m.appendRepeated(f.GetNumber(), v)
+		return
+	}
+	m.fields[f.GetNumber()] = v
+}
+
+// newNested constructs an empty Message for a message- or group-typed
+// field, preferring m's MessageFactory (if any) so cross-file references
+// resolve correctly, and falling back to f's enclosing message's own
+// NestedType list, which covers the common case of a field whose type is
+// declared directly inside m's message without needing a factory at all.
+// Types nested anywhere else (a sibling of m's message, for instance) are
+// found only through the factory.
+func (m *Message) newNested(f *FieldDescriptorProto) (*Message, os.Error) {
+	if m.mf != nil {
+		if nested, err := m.mf.NewMessage(f.GetTypeName()); err == nil {
+			return nested, nil
+		}
+	}
+	for _, nt := range m.desc.NestedType {
+		if nt.GetName() == f.GetTypeName() || "."+nt.GetName() == f.GetTypeName() {
+			return NewMessage(nt, m.mf), nil
+		}
+	}
+	return nil, os.NewError("dynamic: cannot resolve message type " + f.GetTypeName() + " for field " + f.GetName())
+}
+
+// enumFor resolves the EnumDescriptorProto of an enum-typed field,
+// preferring m's MessageFactory (if any) and falling back to m's own
+// enclosing message's EnumType list, the same way newNested falls back to
+// NestedType for message-typed fields.
+func (m *Message) enumFor(f *FieldDescriptorProto) (*EnumDescriptorProto, os.Error) {
+	if m.mf != nil {
+		if enum, err := m.mf.Enum(f.GetTypeName()); err == nil {
+			return enum, nil
+		}
+	}
+	for _, e := range m.desc.EnumType {
+		if e.GetName() == f.GetTypeName() || "."+e.GetName() == f.GetTypeName() {
+			return e, nil
+		}
+	}
+	return nil, os.NewError("dynamic: cannot resolve enum type " + f.GetTypeName() + " for field " + f.GetName())
+}
@@ -0,0 +1,206 @@
+package dynamic
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+	"goprotobuf.googlecode.com/hg/proto"
+)
+
+// buildTestSchema returns a small proto3 schema for the round-trip tests
+// below: a top-level enum Color, and a message Outer with a string field,
+// an enum-typed field, a repeated (implicitly packed, since the schema is
+// proto3) scalar field, and a nested message field.
+func buildTestSchema() (*FileDescriptorSet, *DescriptorProto) {
+	color := &EnumDescriptorProto{
+		Name: proto.String("Color"),
+		Value: []*EnumValueDescriptorProto{
+			{Name: proto.String("RED"), Number: proto.Int32(0)},
+			{Name: proto.String("GREEN"), Number: proto.Int32(1)},
+		},
+	}
+
+	inner := &DescriptorProto{
+		Name: proto.String("Inner"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:   proto.String("x"),
+				Number: proto.Int32(1),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_INT32),
+			},
+		},
+	}
+
+	outer := &DescriptorProto{
+		Name: proto.String("Outer"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:   proto.String("name"),
+				Number: proto.Int32(1),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_STRING),
+			},
+			{
+				Name:     proto.String("color"),
+				Number:   proto.Int32(2),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:     NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_ENUM),
+				TypeName: proto.String(".t.Color"),
+			},
+			{
+				Name:   proto.String("tags"),
+				Number: proto.Int32(3),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_REPEATED),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_INT32),
+			},
+			{
+				Name:     proto.String("inner"),
+				Number:   proto.Int32(4),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:     NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE),
+				TypeName: proto.String(".t.Outer.Inner"),
+			},
+		},
+		NestedType: []*DescriptorProto{inner},
+	}
+
+	fd := &FileDescriptorProto{
+		Name:        proto.String("test.proto"),
+		Package:     proto.String("t"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*DescriptorProto{outer},
+		EnumType:    []*EnumDescriptorProto{color},
+	}
+
+	return &FileDescriptorSet{File: []*FileDescriptorProto{fd}}, outer
+}
+
+func TestMarshalUnmarshalRoundTrip(t *testing.T) {
+	fds, outer := buildTestSchema()
+	mf := NewMessageFactory(fds)
+
+	m := NewMessage(outer, mf)
+	m.Set(1, "hello")
+	m.Set(2, int32(1)) // GREEN
+	m.Set(3, []interface{}{int32(1), int32(2), int32(3)})
+
+	inner, err := m.newNested(outer.Field[3])
+	if err != nil {
+		t.Fatalf("newNested: %v", err)
+	}
+	inner.Set(1, int32(42))
+	m.Set(4, inner)
+
+	buf, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	got := NewMessage(outer, mf)
+	if err := got.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if v, _ := got.Get(1); v.(string) != "hello" {
+		t.Errorf("name = %v, want hello", v)
+	}
+	if v, _ := got.Get(2); v.(int32) != 1 {
+		t.Errorf("color = %v, want 1", v)
+	}
+	if v, _ := got.Get(3); !reflect.DeepEqual(v, []interface{}{int32(1), int32(2), int32(3)}) {
+		t.Errorf("tags = %v, want [1 2 3]", v)
+	}
+
+	v4, ok := got.Get(4)
+	if !ok {
+		t.Fatal("inner field not set after unmarshal")
+	}
+	gotInner := v4.(*Message)
+	if x, _ := gotInner.Get(1); x.(int32) != 42 {
+		t.Errorf("inner.x = %v, want 42", x)
+	}
+}
+
+// TestTextFormatEnumRoundTrip covers the chunk0-5 fix: enum fields must
+// marshal and unmarshal by their symbolic name, not the raw wire number.
+func TestTextFormatEnumRoundTrip(t *testing.T) {
+	fds, outer := buildTestSchema()
+	mf := NewMessageFactory(fds)
+
+	m := NewMessage(outer, mf)
+	m.Set(1, "hello")
+	m.Set(2, int32(1)) // GREEN
+
+	txt, err := m.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText: %v", err)
+	}
+	if !strings.Contains(string(txt), "color: GREEN") {
+		t.Errorf("MarshalText = %q, want it to contain \"color: GREEN\"", txt)
+	}
+
+	got := NewMessage(outer, mf)
+	if err := got.UnmarshalText(txt); err != nil {
+		t.Fatalf("UnmarshalText: %v", err)
+	}
+	if v, _ := got.Get(2); v.(int32) != 1 {
+		t.Errorf("color = %v, want 1 (GREEN)", v)
+	}
+}
+
+// TestTextFormatUnknownEnumNameErrors covers the other half of the
+// chunk0-5 fix: an unresolvable enum value name must be reported as an
+// error rather than silently decoded as -1.
+func TestTextFormatUnknownEnumNameErrors(t *testing.T) {
+	fds, outer := buildTestSchema()
+	mf := NewMessageFactory(fds)
+
+	m := NewMessage(outer, mf)
+	if err := m.UnmarshalText([]byte("color: PURPLE\n")); err == nil {
+		t.Fatal("UnmarshalText with an unknown enum name: got no error, want one")
+	}
+}
+
+// TestPackedByDefaultForProto3 covers the chunk0-5 fix making repeated
+// scalar fields pack by default under proto3, with no explicit
+// "[packed = true]" on the field.
+func TestPackedByDefaultForProto3(t *testing.T) {
+	fds, outer := buildTestSchema()
+	mf := NewMessageFactory(fds)
+
+	m := NewMessage(outer, mf)
+	m.Set(3, []interface{}{int32(1), int32(2), int32(3)})
+
+	buf, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	// A packed repeated field is one tag followed by one length-delimited
+	// run, rather than one tag per element; count the tags for field 3.
+	tagsField := 0
+	r := &reader{buf: buf}
+	for !r.done() {
+		tag, err := r.readVarint()
+		if err != nil {
+			t.Fatalf("readVarint: %v", err)
+		}
+		num := int32(tag >> 3)
+		wireType := int(tag & 7)
+		if num == 3 {
+			tagsField++
+			if wireType != wireBytes {
+				t.Errorf("field 3 wire type = %d, want %d (length-delimited, i.e. packed)", wireType, wireBytes)
+			}
+		}
+		if err := r.skip(wireType); err != nil {
+			t.Fatalf("skip: %v", err)
+		}
+	}
+	if tagsField != 1 {
+		t.Errorf("saw %d tags for field 3, want 1 (packed into a single run)", tagsField)
+	}
+}
@@ -0,0 +1,424 @@
+package dynamic
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// MarshalText renders m in the standard protoc text format: one
+// "field_name: value" line per scalar field, "field_name { ... }" for a
+// nested message, and "field_name: [v1, v2, ...]" for a repeated field of
+// either kind.
+func (m *Message) MarshalText() ([]byte, os.Error) {
+	var buf bytes.Buffer
+	if err := m.writeText(&buf, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Message) writeText(buf *bytes.Buffer, depth int) os.Error {
+	indent := strings.Repeat("  ", depth)
+	for _, f := range m.desc.Field {
+		v, ok := m.fields[f.GetNumber()]
+		if !ok {
+			continue
+		}
+
+		buf.WriteString(indent)
+		buf.WriteString(f.GetName())
+
+		if f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED {
+			vals := v.([]interface{})
+			buf.WriteString(": [")
+			for i, elem := range vals {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				if err := m.writeTextValue(buf, f, elem, depth); err != nil {
+					return err
+				}
+			}
+			buf.WriteString("]\n")
+			continue
+		}
+
+		if f.GetType() == FieldDescriptorProto_TYPE_MESSAGE || f.GetType() == FieldDescriptorProto_TYPE_GROUP {
+			buf.WriteString(" {\n")
+			if err := v.(*Message).writeText(buf, depth+1); err != nil {
+				return err
+			}
+			buf.WriteString(indent)
+			buf.WriteString("}\n")
+			continue
+		}
+
+		buf.WriteString(": ")
+		if err := m.writeTextValue(buf, f, v, depth); err != nil {
+			return err
+		}
+		buf.WriteString("\n")
+	}
+	return nil
+}
+
+func (m *Message) writeTextValue(buf *bytes.Buffer, f *FieldDescriptorProto, v interface{}, depth int) os.Error {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_MESSAGE, FieldDescriptorProto_TYPE_GROUP:
+		buf.WriteString("{")
+		if err := v.(*Message).writeText(buf, depth+1); err != nil {
+			return err
+		}
+		buf.WriteString(strings.Repeat("  ", depth))
+		buf.WriteString("}")
+	case FieldDescriptorProto_TYPE_STRING:
+		buf.WriteString("\"")
+		buf.WriteString(textEscape(v.(string)))
+		buf.WriteString("\"")
+	case FieldDescriptorProto_TYPE_BYTES:
+		buf.WriteString("\"")
+		buf.WriteString(textEscape(string(v.([]byte))))
+		buf.WriteString("\"")
+	case FieldDescriptorProto_TYPE_BOOL:
+		if v.(bool) {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case FieldDescriptorProto_TYPE_ENUM:
+		enum, err := m.enumFor(f)
+		if err != nil {
+			return err
+		}
+		num := v.(int32)
+		var name string
+		for _, ev := range enum.Value {
+			if ev.GetNumber() == num {
+				name = ev.GetName()
+				break
+			}
+		}
+		if name == "" {
+			return os.NewError("dynamic: no enum value " + strconv.Itoa64(int64(num)) + " in " + enum.GetName() + " for field " + f.GetName())
+		}
+		buf.WriteString(name)
+	case FieldDescriptorProto_TYPE_FLOAT:
+		buf.WriteString(strconv.Ftoa32(v.(float32), 'g', -1))
+	case FieldDescriptorProto_TYPE_DOUBLE:
+		buf.WriteString(strconv.Ftoa64(v.(float64), 'g', -1))
+	case FieldDescriptorProto_TYPE_INT64, FieldDescriptorProto_TYPE_SINT64, FieldDescriptorProto_TYPE_SFIXED64:
+		buf.WriteString(strconv.Itoa64(v.(int64)))
+	case FieldDescriptorProto_TYPE_INT32, FieldDescriptorProto_TYPE_SINT32, FieldDescriptorProto_TYPE_SFIXED32:
+		buf.WriteString(strconv.Itoa64(int64(v.(int32))))
+	case FieldDescriptorProto_TYPE_UINT64, FieldDescriptorProto_TYPE_FIXED64:
+		buf.WriteString(strconv.Uitoa64(v.(uint64)))
+	case FieldDescriptorProto_TYPE_UINT32, FieldDescriptorProto_TYPE_FIXED32:
+		buf.WriteString(strconv.Uitoa64(uint64(v.(uint32))))
+	default:
+		return os.NewError("dynamic: unsupported field type for " + f.GetName())
+	}
+	return nil
+}
+
+// textEscape renders s the way protoc renders a string field's text-format
+// value: double quotes and backslashes are escaped, newlines become \n,
+// and everything else is passed through unchanged.
+func textEscape(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			out = append(out, '\\', '"')
+		case '\\':
+			out = append(out, '\\', '\\')
+		case '\n':
+			out = append(out, '\\', 'n')
+		default:
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
+
+// UnmarshalText implements text-format decoding into m, replacing any
+// values m already held. It accepts both "{...}" and the older "<...>"
+// delimiters for message-typed fields, and the compact "name: [v1, v2]"
+// form for repeated fields.
+func (m *Message) UnmarshalText(buf []byte) os.Error {
+	m.fields = make(map[int32]interface{})
+	m.unknown = nil
+	t := &textReader{s: string(buf)}
+	return m.readTextFields(t, 0)
+}
+
+func (m *Message) readTextFields(t *textReader, depth int) os.Error {
+	for {
+		t.skipSpace()
+		if len(t.s) == 0 {
+			if depth > 0 {
+				return os.NewError("dynamic: unexpected end of input inside message")
+			}
+			return nil
+		}
+		if depth > 0 && (t.s[0] == '}' || t.s[0] == '>') {
+			t.s = t.s[1:]
+			return nil
+		}
+
+		name, err := t.readIdent()
+		if err != nil {
+			return err
+		}
+		f := m.fieldByName(name)
+		if f == nil {
+			return os.NewError("dynamic: unknown field " + name)
+		}
+
+		if t.peek() == ':' {
+			t.s = t.s[1:]
+		}
+
+		if t.peek() == '[' {
+			t.s = t.s[1:]
+			for {
+				v, err := m.readTextValue(t, f)
+				if err != nil {
+					return err
+				}
+				m.setOrAppend(f, v)
+				if t.peek() == ',' {
+					t.s = t.s[1:]
+					continue
+				}
+				break
+			}
+			if err := t.expect(']'); err != nil {
+				return err
+			}
+			continue
+		}
+
+		v, err := m.readTextValue(t, f)
+		if err != nil {
+			return err
+		}
+		m.setOrAppend(f, v)
+	}
+}
+
+func (m *Message) readTextValue(t *textReader, f *FieldDescriptorProto) (interface{}, os.Error) {
+	if f.GetType() == FieldDescriptorProto_TYPE_MESSAGE || f.GetType() == FieldDescriptorProto_TYPE_GROUP {
+		c := t.peek()
+		if c != '{' && c != '<' {
+			return nil, os.NewError("dynamic: expected '{' for field " + f.GetName())
+		}
+		t.s = t.s[1:]
+		nested, err := m.newNested(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := nested.readTextFields(t, 1); err != nil {
+			return nil, err
+		}
+		return nested, nil
+	}
+
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_STRING:
+		return t.readQuoted()
+	case FieldDescriptorProto_TYPE_BYTES:
+		s, err := t.readQuoted()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	case FieldDescriptorProto_TYPE_BOOL:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		return ident == "true" || ident == "1", nil
+	case FieldDescriptorProto_TYPE_ENUM:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		if n, convErr := strconv.Atoi(ident); convErr == nil {
+			return int32(n), nil
+		}
+		enum, err := m.enumFor(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range enum.Value {
+			if ev.GetName() == ident {
+				return ev.GetNumber(), nil
+			}
+		}
+		return nil, os.NewError("dynamic: unknown enum value " + ident + " for field " + f.GetName())
+	case FieldDescriptorProto_TYPE_FLOAT:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		v, convErr := strconv.Atof32(ident)
+		if convErr != nil {
+			return nil, os.NewError("dynamic: bad float " + ident)
+		}
+		return v, nil
+	case FieldDescriptorProto_TYPE_DOUBLE:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		v, convErr := strconv.Atof64(ident)
+		if convErr != nil {
+			return nil, os.NewError("dynamic: bad float " + ident)
+		}
+		return v, nil
+	case FieldDescriptorProto_TYPE_INT32, FieldDescriptorProto_TYPE_SINT32, FieldDescriptorProto_TYPE_SFIXED32:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		n, convErr := strconv.Atoi64(ident)
+		if convErr != nil {
+			return nil, os.NewError("dynamic: bad integer " + ident)
+		}
+		return int32(n), nil
+	case FieldDescriptorProto_TYPE_INT64, FieldDescriptorProto_TYPE_SINT64, FieldDescriptorProto_TYPE_SFIXED64:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		n, convErr := strconv.Atoi64(ident)
+		if convErr != nil {
+			return nil, os.NewError("dynamic: bad integer " + ident)
+		}
+		return n, nil
+	case FieldDescriptorProto_TYPE_UINT32, FieldDescriptorProto_TYPE_FIXED32:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		n, convErr := strconv.Atoui64(ident)
+		if convErr != nil {
+			return nil, os.NewError("dynamic: bad integer " + ident)
+		}
+		return uint32(n), nil
+	case FieldDescriptorProto_TYPE_UINT64, FieldDescriptorProto_TYPE_FIXED64:
+		ident, err := t.readIdent()
+		if err != nil {
+			return nil, err
+		}
+		n, convErr := strconv.Atoui64(ident)
+		if convErr != nil {
+			return nil, os.NewError("dynamic: bad integer " + ident)
+		}
+		return n, nil
+	}
+	return nil, os.NewError("dynamic: unsupported field type for " + f.GetName())
+}
+
+// textReader is a small cursor over proto text-format source, used by
+// UnmarshalText. It is independent of the parser package's tokenizer,
+// which is built around descriptor.proto grammar rather than text-format
+// value grammar.
+type textReader struct {
+	s string
+}
+
+func (t *textReader) skipSpace() {
+	for len(t.s) > 0 {
+		switch c := t.s[0]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			t.s = t.s[1:]
+		case c == '#':
+			i := 0
+			for i < len(t.s) && t.s[i] != '\n' {
+				i++
+			}
+			t.s = t.s[i:]
+		default:
+			return
+		}
+	}
+}
+
+func (t *textReader) peek() byte {
+	t.skipSpace()
+	if len(t.s) == 0 {
+		return 0
+	}
+	return t.s[0]
+}
+
+func (t *textReader) readIdent() (string, os.Error) {
+	t.skipSpace()
+	i := 0
+	for i < len(t.s) && isTextIdentByte(t.s[i]) {
+		i++
+	}
+	if i == 0 {
+		return "", os.NewError("dynamic: expected identifier")
+	}
+	name := t.s[:i]
+	t.s = t.s[i:]
+	return name, nil
+}
+
+func isTextIdentByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return c == '_' || c == '-' || c == '.' || c == '+'
+}
+
+func (t *textReader) expect(c byte) os.Error {
+	t.skipSpace()
+	if len(t.s) == 0 || t.s[0] != c {
+		return os.NewError("dynamic: expected " + string(c))
+	}
+	t.s = t.s[1:]
+	return nil
+}
+
+func (t *textReader) readQuoted() (string, os.Error) {
+	t.skipSpace()
+	if len(t.s) == 0 || (t.s[0] != '"' && t.s[0] != '\'') {
+		return "", os.NewError("dynamic: expected quoted string")
+	}
+	quote := t.s[0]
+	i := 1
+	out := make([]byte, 0, len(t.s))
+	for i < len(t.s) && t.s[i] != quote {
+		c := t.s[i]
+		if c == '\\' && i+1 < len(t.s) {
+			i++
+			switch t.s[i] {
+			case 'n':
+				out = append(out, '\n')
+			case 't':
+				out = append(out, '\t')
+			case 'r':
+				out = append(out, '\r')
+			default:
+				out = append(out, t.s[i])
+			}
+			i++
+			continue
+		}
+		out = append(out, c)
+		i++
+	}
+	if i >= len(t.s) {
+		return "", os.NewError("dynamic: unterminated string")
+	}
+	t.s = t.s[i+1:]
+	return string(out), nil
+}
@@ -0,0 +1,150 @@
+package dynamic
+
+import "os"
+
+// Wire types, as defined by the protocol buffer wire format.
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendFixed32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendFixed64(buf []byte, v uint64) []byte {
+	return append(buf,
+		byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func appendTag(buf []byte, num int32, wireType int) []byte {
+	return appendVarint(buf, uint64(num)<<3|uint64(wireType))
+}
+
+func zigzagEncode32(v int32) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+func zigzagDecode32(v uint32) int32 {
+	return int32(v>>1) ^ -int32(v&1)
+}
+
+func zigzagEncode64(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func zigzagDecode64(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// reader is a cursor over a wire-format byte slice, used to decode a
+// single message's fields (or, recursively, a nested message's).
+type reader struct {
+	buf []byte
+	i   int
+}
+
+func (r *reader) done() bool {
+	return r.i >= len(r.buf)
+}
+
+func (r *reader) readVarint() (uint64, os.Error) {
+	var v uint64
+	var shift uint
+	for {
+		if r.i >= len(r.buf) {
+			return 0, os.NewError("dynamic: truncated varint")
+		}
+		b := r.buf[r.i]
+		r.i++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+		shift += 7
+		if shift >= 64 {
+			return 0, os.NewError("dynamic: varint too long")
+		}
+	}
+}
+
+func (r *reader) readFixed32() (uint32, os.Error) {
+	if r.i+4 > len(r.buf) {
+		return 0, os.NewError("dynamic: truncated 32-bit value")
+	}
+	v := uint32(r.buf[r.i]) | uint32(r.buf[r.i+1])<<8 | uint32(r.buf[r.i+2])<<16 | uint32(r.buf[r.i+3])<<24
+	r.i += 4
+	return v, nil
+}
+
+func (r *reader) readFixed64() (uint64, os.Error) {
+	if r.i+8 > len(r.buf) {
+		return 0, os.NewError("dynamic: truncated 64-bit value")
+	}
+	var v uint64
+	for j := 0; j < 8; j++ {
+		v |= uint64(r.buf[r.i+j]) << (8 * uint(j))
+	}
+	r.i += 8
+	return v, nil
+}
+
+func (r *reader) readBytes() ([]byte, os.Error) {
+	n, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if r.i+int(n) > len(r.buf) {
+		return nil, os.NewError("dynamic: truncated length-delimited value")
+	}
+	b := r.buf[r.i : r.i+int(n)]
+	r.i += int(n)
+	return b, nil
+}
+
+// skip consumes and discards a value of the given wire type, used to step
+// over an unrecognized field (its raw bytes are captured separately by
+// the caller, which knows where the value started).
+func (r *reader) skip(wireType int) os.Error {
+	switch wireType {
+	case wireVarint:
+		_, err := r.readVarint()
+		return err
+	case wireFixed64:
+		_, err := r.readFixed64()
+		return err
+	case wireBytes:
+		_, err := r.readBytes()
+		return err
+	case wireFixed32:
+		_, err := r.readFixed32()
+		return err
+	case wireStartGroup:
+		for {
+			tag, err := r.readVarint()
+			if err != nil {
+				return err
+			}
+			if int(tag&7) == wireEndGroup {
+				return nil
+			}
+			if err := r.skip(int(tag & 7)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.NewError("dynamic: unknown wire type")
+}
@@ -0,0 +1,283 @@
+// Package flagpb populates a dynamic.Message from a slice of command-line
+// style arguments, so a DescriptorProto produced by the parser package can
+// be used directly as the schema for a generic CLI-to-protobuf tool,
+// without any generated Go type standing between the flags and the wire.
+package flagpb
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nilslice/gotoc/dynamic"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// Populate builds a *dynamic.Message for root by interpreting args as a
+// sequence of flags, one per field:
+//
+//	-field value
+//	-field=value
+//	-outer.inner.leaf=value   (dotted path into a nested message)
+//	-repeated_field v1 -repeated_field v2   (repeat to append)
+//	-map_field key=value
+//	-sub_message '{"a":1}'   (whole submessage as a JSON literal)
+//
+// mf resolves the message type of any message- or group-typed field that
+// Populate needs to create along the way; it may be nil if root has no
+// such fields. Populate itself does not read fd; the -help / --help text
+// is rendered from fd's SourceCodeInfo by Help, as described below.
+//
+// If args contains "-help" or "--help", Populate stops at that flag and
+// returns helpRequested == true with a nil message and error; it is the
+// caller's responsibility to print Help(fd, root) and exit, since a
+// library function terminating the process itself would make this path
+// untestable and would surprise any caller that wants to handle -help
+// differently (e.g. printing it to a different stream).
+func Populate(fd *FileDescriptorProto, root *DescriptorProto, mf *dynamic.MessageFactory, args []string) (msg *dynamic.Message, helpRequested bool, err os.Error) {
+	msg = dynamic.NewMessage(root, mf)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-help" || arg == "--help" {
+			return nil, true, nil
+		}
+		if len(arg) == 0 || arg[0] != '-' {
+			return nil, false, os.NewError("flagpb: unexpected argument " + arg)
+		}
+
+		name := arg[1:]
+		if len(name) > 0 && name[0] == '-' {
+			name = name[1:]
+		}
+
+		var value string
+		if eq := strings.Index(name, "="); eq >= 0 {
+			value = name[eq+1:]
+			name = name[:eq]
+		} else {
+			i++
+			if i >= len(args) {
+				return nil, false, os.NewError("flagpb: flag -" + name + " is missing a value")
+			}
+			value = args[i]
+		}
+
+		if err := setByPath(msg, root, mf, strings.Split(name, "."), value); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return msg, false, nil
+}
+
+// setByPath walks path into msg, creating intermediate nested messages as
+// it goes, and applies value to the field named by path's final element.
+func setByPath(msg *dynamic.Message, desc *DescriptorProto, mf *dynamic.MessageFactory, path []string, value string) os.Error {
+	f := fieldNamed(desc, path[0])
+	if f == nil {
+		return os.NewError("flagpb: unknown field " + path[0])
+	}
+
+	if len(path) > 1 {
+		if f.GetType() != FieldDescriptorProto_TYPE_MESSAGE {
+			return os.NewError("flagpb: " + path[0] + " is not a message, so it has no field " + path[1])
+		}
+		nestedDesc, err := nestedDescriptor(desc, f, mf)
+		if err != nil {
+			return err
+		}
+		existing, _ := msg.Get(f.GetNumber())
+		nested, ok := existing.(*dynamic.Message)
+		if !ok {
+			nested = dynamic.NewMessage(nestedDesc, mf)
+			msg.Set(f.GetNumber(), nested)
+		}
+		return setByPath(nested, nestedDesc, mf, path[1:], value)
+	}
+
+	return setLeaf(msg, desc, f, mf, value)
+}
+
+// setLeaf applies value, taken straight from the command line, to f.
+func setLeaf(msg *dynamic.Message, desc *DescriptorProto, f *FieldDescriptorProto, mf *dynamic.MessageFactory, value string) os.Error {
+	if f.GetType() == FieldDescriptorProto_TYPE_MESSAGE {
+		nestedDesc, err := nestedDescriptor(desc, f, mf)
+		if err != nil {
+			return err
+		}
+
+		if nestedDesc.Options != nil && nestedDesc.Options.GetMapEntry() {
+			return setMapEntry(msg, f, nestedDesc, mf, value)
+		}
+
+		if len(value) > 0 && value[0] == '{' {
+			sub := dynamic.NewMessage(nestedDesc, mf)
+			if err := applyJSONLiteral(sub, nestedDesc, mf, value); err != nil {
+				return err
+			}
+			if f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED {
+				msg.Set(f.GetNumber(), appendValue(msg, f.GetNumber(), sub))
+			} else {
+				msg.Set(f.GetNumber(), sub)
+			}
+			return nil
+		}
+
+		return os.NewError("flagpb: field " + f.GetName() + " is a message; set it with a dotted path (-" + f.GetName() + ".field=...) or a JSON literal")
+	}
+
+	v, err := parseScalar(f, value)
+	if err != nil {
+		return err
+	}
+	if f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED {
+		msg.Set(f.GetNumber(), appendValue(msg, f.GetNumber(), v))
+	} else {
+		msg.Set(f.GetNumber(), v)
+	}
+	return nil
+}
+
+// setMapEntry handles "-map_field key=value", building a single entry
+// message (the synthetic FooEntry message the parser generates for every
+// map field, see parser.go's readMapField) and appending it to f.
+func setMapEntry(msg *dynamic.Message, f *FieldDescriptorProto, entryDesc *DescriptorProto, mf *dynamic.MessageFactory, value string) os.Error {
+	eq := strings.Index(value, "=")
+	if eq < 0 {
+		return os.NewError("flagpb: map field " + f.GetName() + " needs key=value, got " + value)
+	}
+	keyStr, valStr := value[:eq], value[eq+1:]
+
+	keyField := fieldNamed(entryDesc, "key")
+	valField := fieldNamed(entryDesc, "value")
+	if keyField == nil || valField == nil {
+		return os.NewError("flagpb: " + f.GetName() + " is not a map field")
+	}
+
+	entry := dynamic.NewMessage(entryDesc, mf)
+
+	kv, err := parseScalar(keyField, keyStr)
+	if err != nil {
+		return err
+	}
+	entry.Set(keyField.GetNumber(), kv)
+
+	if valField.GetType() == FieldDescriptorProto_TYPE_MESSAGE {
+		p := &jsonParser{s: valStr}
+		raw, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+		valDesc, err := nestedDescriptor(entryDesc, valField, mf)
+		if err != nil {
+			return err
+		}
+		vv, err := jsonToField(valDesc, valField, mf, raw)
+		if err != nil {
+			return err
+		}
+		entry.Set(valField.GetNumber(), vv)
+	} else {
+		vv, err := parseScalar(valField, valStr)
+		if err != nil {
+			return err
+		}
+		entry.Set(valField.GetNumber(), vv)
+	}
+
+	msg.Set(f.GetNumber(), appendValue(msg, f.GetNumber(), entry))
+	return nil
+}
+
+func fieldNamed(desc *DescriptorProto, name string) *FieldDescriptorProto {
+	for _, f := range desc.Field {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// nestedDescriptor resolves the message type of a message- or group-typed
+// field, preferring mf (so references to messages outside parent resolve
+// correctly) and falling back to parent's own NestedType list.
+func nestedDescriptor(parent *DescriptorProto, f *FieldDescriptorProto, mf *dynamic.MessageFactory) (*DescriptorProto, os.Error) {
+	if mf != nil {
+		if m, err := mf.NewMessage(f.GetTypeName()); err == nil {
+			return m.Descriptor(), nil
+		}
+	}
+	for _, nt := range parent.NestedType {
+		if nt.GetName() == f.GetTypeName() || "."+nt.GetName() == f.GetTypeName() {
+			return nt, nil
+		}
+	}
+	return nil, os.NewError("flagpb: cannot resolve message type " + f.GetTypeName() + " for field " + f.GetName())
+}
+
+// appendValue returns the []interface{} for f's repeated field number num
+// with v appended, for use as the new value passed to msg.Set.
+func appendValue(msg *dynamic.Message, num int32, v interface{}) []interface{} {
+	existing, _ := msg.Get(num)
+	vals, _ := existing.([]interface{})
+	return append(vals, v)
+}
+
+// parseScalar converts the string form of a flag or map key/value into the
+// Go type dynamic.Message expects for f (see appendScalar in
+// dynamic/marshal.go for the authoritative type table).
+func parseScalar(f *FieldDescriptorProto, s string) (interface{}, os.Error) {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_STRING:
+		return s, nil
+	case FieldDescriptorProto_TYPE_BYTES:
+		return []byte(s), nil
+	case FieldDescriptorProto_TYPE_BOOL:
+		return s == "true" || s == "1", nil
+	case FieldDescriptorProto_TYPE_ENUM:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: enum field " + f.GetName() + " needs a numeric value, got " + s)
+		}
+		return int32(n), nil
+	case FieldDescriptorProto_TYPE_FLOAT:
+		v, err := strconv.Atof32(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: bad float for " + f.GetName() + ": " + s)
+		}
+		return v, nil
+	case FieldDescriptorProto_TYPE_DOUBLE:
+		v, err := strconv.Atof64(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: bad double for " + f.GetName() + ": " + s)
+		}
+		return v, nil
+	case FieldDescriptorProto_TYPE_INT32, FieldDescriptorProto_TYPE_SINT32, FieldDescriptorProto_TYPE_SFIXED32:
+		n, err := strconv.Atoi64(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: bad integer for " + f.GetName() + ": " + s)
+		}
+		return int32(n), nil
+	case FieldDescriptorProto_TYPE_INT64, FieldDescriptorProto_TYPE_SINT64, FieldDescriptorProto_TYPE_SFIXED64:
+		n, err := strconv.Atoi64(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: bad integer for " + f.GetName() + ": " + s)
+		}
+		return n, nil
+	case FieldDescriptorProto_TYPE_UINT32, FieldDescriptorProto_TYPE_FIXED32:
+		n, err := strconv.Atoui64(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: bad unsigned integer for " + f.GetName() + ": " + s)
+		}
+		return uint32(n), nil
+	case FieldDescriptorProto_TYPE_UINT64, FieldDescriptorProto_TYPE_FIXED64:
+		n, err := strconv.Atoui64(s)
+		if err != nil {
+			return nil, os.NewError("flagpb: bad unsigned integer for " + f.GetName() + ": " + s)
+		}
+		return n, nil
+	}
+	return nil, os.NewError("flagpb: unsupported field type for " + f.GetName())
+}
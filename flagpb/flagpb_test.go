@@ -0,0 +1,161 @@
+package flagpb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nilslice/gotoc/dynamic"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+	"goprotobuf.googlecode.com/hg/proto"
+)
+
+// buildRootDescriptor returns a DescriptorProto for Populate's tests: a
+// plain string field, a repeated string field, a nested message field and
+// a map field, all resolvable through root's own NestedType list (so the
+// tests don't need a MessageFactory).
+func buildRootDescriptor() *DescriptorProto {
+	inner := &DescriptorProto{
+		Name: proto.String("Inner"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:   proto.String("x"),
+				Number: proto.Int32(1),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_STRING),
+			},
+		},
+	}
+
+	labelsEntry := &DescriptorProto{
+		Name: proto.String("LabelsEntry"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:   proto.String("key"),
+				Number: proto.Int32(1),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_STRING),
+			},
+			{
+				Name:   proto.String("value"),
+				Number: proto.Int32(2),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_STRING),
+			},
+		},
+		Options: &MessageOptions{MapEntry: proto.Bool(true)},
+	}
+
+	return &DescriptorProto{
+		Name: proto.String("Root"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:   proto.String("name"),
+				Number: proto.Int32(1),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_STRING),
+			},
+			{
+				Name:   proto.String("tags"),
+				Number: proto.Int32(2),
+				Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_REPEATED),
+				Type:   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_STRING),
+			},
+			{
+				Name:     proto.String("inner"),
+				Number:   proto.Int32(3),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				Type:     NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE),
+				TypeName: proto.String("Inner"),
+			},
+			{
+				Name:     proto.String("labels"),
+				Number:   proto.Int32(4),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_REPEATED),
+				Type:     NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE),
+				TypeName: proto.String("LabelsEntry"),
+			},
+		},
+		NestedType: []*DescriptorProto{inner, labelsEntry},
+	}
+}
+
+// TestPopulate covers a plain scalar flag, a repeated flag given twice, a
+// dotted path into a nested message, and a "key=value" map field flag.
+func TestPopulate(t *testing.T) {
+	root := buildRootDescriptor()
+	args := []string{
+		"-name=hello",
+		"-tags", "a",
+		"-tags", "b",
+		"-inner.x=deep",
+		"-labels", "k=v",
+	}
+
+	msg, help, err := Populate(nil, root, nil, args)
+	if err != nil {
+		t.Fatalf("Populate: %v", err)
+	}
+	if help {
+		t.Fatal("Populate reported helpRequested for a flag list with no -help")
+	}
+
+	if v, _ := msg.Get(1); v.(string) != "hello" {
+		t.Errorf("name = %v, want hello", v)
+	}
+	if v, _ := msg.Get(2); !reflect.DeepEqual(v, []interface{}{"a", "b"}) {
+		t.Errorf("tags = %v, want [a b]", v)
+	}
+
+	v3, ok := msg.Get(3)
+	if !ok {
+		t.Fatal("inner field not set")
+	}
+	inner := v3.(*dynamic.Message)
+	if x, _ := inner.Get(1); x.(string) != "deep" {
+		t.Errorf("inner.x = %v, want deep", x)
+	}
+
+	v4, ok := msg.Get(4)
+	if !ok {
+		t.Fatal("labels field not set")
+	}
+	entries := v4.([]interface{})
+	if len(entries) != 1 {
+		t.Fatalf("got %d label entries, want 1", len(entries))
+	}
+	entry := entries[0].(*dynamic.Message)
+	if k, _ := entry.Get(1); k.(string) != "k" {
+		t.Errorf("labels[0].key = %v, want k", k)
+	}
+	if v, _ := entry.Get(2); v.(string) != "v" {
+		t.Errorf("labels[0].value = %v, want v", v)
+	}
+}
+
+// TestPopulateUnknownField covers Populate's error path for a flag that
+// names a field not present in root.
+func TestPopulateUnknownField(t *testing.T) {
+	root := buildRootDescriptor()
+	if _, _, err := Populate(nil, root, nil, []string{"-bogus=1"}); err == nil {
+		t.Fatal("Populate with an unknown field: got no error, want one")
+	}
+}
+
+// TestPopulateHelp covers Populate's -help handling: it must report
+// helpRequested and stop, rather than printing Help itself and exiting
+// the process, so the caller can decide how to handle it (and so this
+// path is testable at all).
+func TestPopulateHelp(t *testing.T) {
+	root := buildRootDescriptor()
+	msg, help, err := Populate(nil, root, nil, []string{"-help"})
+	if err != nil {
+		t.Fatalf("Populate: %v", err)
+	}
+	if !help {
+		t.Fatal("Populate with -help: helpRequested = false, want true")
+	}
+	if msg != nil {
+		t.Errorf("Populate with -help: message = %v, want nil", msg)
+	}
+}
@@ -0,0 +1,106 @@
+package flagpb
+
+import (
+	"bytes"
+	"fmt"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// descriptor.proto field numbers used to build SourceCodeInfo paths; kept
+// local to this package the same way parser/sourceinfo.go keeps its own
+// copies, since the two packages don't share unexported constants.
+const (
+	fileMessageTypeField = 4
+	messageFieldField    = 2
+)
+
+// Help renders a usage listing for every field of root: one "-field type"
+// line per field (with " (repeatable)" appended for a repeated field),
+// followed by an indented line holding the field's leading comment from
+// fd's SourceCodeInfo (see the parser package's sourceinfo.go) when one was
+// recorded. fd may be nil, in which case no comments are shown.
+//
+// root must be one of fd's top-level message types; a nested message
+// passed as root won't have its fields' comments found, since locating
+// them needs the full path down to root rather than just its index in
+// fd.MessageType.
+func Help(fd *FileDescriptorProto, root *DescriptorProto) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Usage of %s:\n", root.GetName())
+
+	msgIdx := -1
+	if fd != nil {
+		for i, m := range fd.MessageType {
+			if m == root {
+				msgIdx = i
+				break
+			}
+		}
+	}
+
+	for i, f := range root.Field {
+		fmt.Fprintf(&buf, "  -%s %s", f.GetName(), typeName(f))
+		if f.GetLabel() == FieldDescriptorProto_LABEL_REPEATED {
+			buf.WriteString(" (repeatable)")
+		}
+		buf.WriteString("\n")
+		if msgIdx >= 0 {
+			if c := fieldComment(fd, msgIdx, i); c != "" {
+				fmt.Fprintf(&buf, "        %s\n", c)
+			}
+		}
+	}
+	return buf.String()
+}
+
+func typeName(f *FieldDescriptorProto) string {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_MESSAGE, FieldDescriptorProto_TYPE_GROUP, FieldDescriptorProto_TYPE_ENUM:
+		return f.GetTypeName()
+	}
+	return scalarTypeNames[f.GetType()]
+}
+
+var scalarTypeNames = map[FieldDescriptorProto_Type]string{
+	FieldDescriptorProto_TYPE_DOUBLE:   "double",
+	FieldDescriptorProto_TYPE_FLOAT:    "float",
+	FieldDescriptorProto_TYPE_INT64:    "int64",
+	FieldDescriptorProto_TYPE_UINT64:   "uint64",
+	FieldDescriptorProto_TYPE_INT32:    "int32",
+	FieldDescriptorProto_TYPE_FIXED64:  "fixed64",
+	FieldDescriptorProto_TYPE_FIXED32:  "fixed32",
+	FieldDescriptorProto_TYPE_BOOL:     "bool",
+	FieldDescriptorProto_TYPE_STRING:   "string",
+	FieldDescriptorProto_TYPE_BYTES:    "bytes",
+	FieldDescriptorProto_TYPE_UINT32:   "uint32",
+	FieldDescriptorProto_TYPE_SFIXED32: "sfixed32",
+	FieldDescriptorProto_TYPE_SFIXED64: "sfixed64",
+	FieldDescriptorProto_TYPE_SINT32:   "sint32",
+	FieldDescriptorProto_TYPE_SINT64:   "sint64",
+}
+
+func fieldComment(fd *FileDescriptorProto, msgIdx, fieldIdx int) string {
+	if fd.SourceCodeInfo == nil {
+		return ""
+	}
+	want := []int32{fileMessageTypeField, int32(msgIdx), messageFieldField, int32(fieldIdx)}
+	for _, loc := range fd.SourceCodeInfo.Location {
+		if pathEqual(loc.Path, want) {
+			return loc.GetLeadingComments()
+		}
+	}
+	return ""
+}
+
+func pathEqual(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package flagpb
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/nilslice/gotoc/dynamic"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// applyJSONLiteral parses s as a JSON object and applies its keys to msg's
+// fields by name, recursing into nested messages and arrays as needed. It
+// is what a whole-submessage flag value like -sub '{"a":1}' goes through.
+func applyJSONLiteral(msg *dynamic.Message, desc *DescriptorProto, mf *dynamic.MessageFactory, s string) os.Error {
+	p := &jsonParser{s: s}
+	v, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return os.NewError("flagpb: expected a JSON object")
+	}
+	return applyJSONObject(msg, desc, mf, obj)
+}
+
+func applyJSONObject(msg *dynamic.Message, desc *DescriptorProto, mf *dynamic.MessageFactory, obj map[string]interface{}) os.Error {
+	for name, raw := range obj {
+		f := fieldNamed(desc, name)
+		if f == nil {
+			return os.NewError("flagpb: unknown field " + name + " in JSON literal")
+		}
+		if list, ok := raw.([]interface{}); ok {
+			for _, elem := range list {
+				v, err := jsonToField(desc, f, mf, elem)
+				if err != nil {
+					return err
+				}
+				msg.Set(f.GetNumber(), appendValue(msg, f.GetNumber(), v))
+			}
+			continue
+		}
+		v, err := jsonToField(desc, f, mf, raw)
+		if err != nil {
+			return err
+		}
+		msg.Set(f.GetNumber(), v)
+	}
+	return nil
+}
+
+// jsonToField converts a single decoded JSON value (string, float64, bool,
+// nil, or map[string]interface{}) into the Go type dynamic.Message expects
+// for f.
+func jsonToField(desc *DescriptorProto, f *FieldDescriptorProto, mf *dynamic.MessageFactory, raw interface{}) (interface{}, os.Error) {
+	if f.GetType() == FieldDescriptorProto_TYPE_MESSAGE {
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError("flagpb: field " + f.GetName() + " expects a JSON object")
+		}
+		nestedDesc, err := nestedDescriptor(desc, f, mf)
+		if err != nil {
+			return nil, err
+		}
+		nested := dynamic.NewMessage(nestedDesc, mf)
+		if err := applyJSONObject(nested, nestedDesc, mf, obj); err != nil {
+			return nil, err
+		}
+		return nested, nil
+	}
+
+	switch v := raw.(type) {
+	case string:
+		return parseScalar(f, v)
+	case bool:
+		if f.GetType() != FieldDescriptorProto_TYPE_BOOL {
+			return nil, os.NewError("flagpb: field " + f.GetName() + " is not a bool")
+		}
+		return v, nil
+	case float64:
+		return jsonNumberToField(f, v)
+	case nil:
+		return nil, os.NewError("flagpb: field " + f.GetName() + " cannot be null")
+	}
+	return nil, os.NewError("flagpb: unsupported JSON value for field " + f.GetName())
+}
+
+func jsonNumberToField(f *FieldDescriptorProto, v float64) (interface{}, os.Error) {
+	switch f.GetType() {
+	case FieldDescriptorProto_TYPE_FLOAT:
+		return float32(v), nil
+	case FieldDescriptorProto_TYPE_DOUBLE:
+		return v, nil
+	case FieldDescriptorProto_TYPE_INT32, FieldDescriptorProto_TYPE_SINT32, FieldDescriptorProto_TYPE_SFIXED32, FieldDescriptorProto_TYPE_ENUM:
+		return int32(v), nil
+	case FieldDescriptorProto_TYPE_INT64, FieldDescriptorProto_TYPE_SINT64, FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(v), nil
+	case FieldDescriptorProto_TYPE_UINT32, FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(v), nil
+	case FieldDescriptorProto_TYPE_UINT64, FieldDescriptorProto_TYPE_FIXED64:
+		return uint64(v), nil
+	}
+	return nil, os.NewError("flagpb: field " + f.GetName() + " is not numeric")
+}
+
+// jsonParser is a minimal recursive-descent JSON reader, just enough to
+// support whole-submessage literals passed as a single flag value: objects,
+// arrays, strings, numbers, booleans and null. It is not meant to be a
+// general-purpose JSON decoder.
+type jsonParser struct {
+	s string
+}
+
+func (p *jsonParser) skipSpace() {
+	for len(p.s) > 0 {
+		switch p.s[0] {
+		case ' ', '\t', '\n', '\r':
+			p.s = p.s[1:]
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) parseValue() (interface{}, os.Error) {
+	p.skipSpace()
+	if len(p.s) == 0 {
+		return nil, os.NewError("flagpb: unexpected end of JSON")
+	}
+	switch p.s[0] {
+	case '{':
+		return p.parseObject()
+	case '[':
+		return p.parseArray()
+	case '"':
+		return p.parseString()
+	case 't':
+		return p.parseLiteral("true", true)
+	case 'f':
+		return p.parseLiteral("false", false)
+	case 'n':
+		return p.parseLiteral("null", nil)
+	}
+	return p.parseNumber()
+}
+
+func (p *jsonParser) parseLiteral(lit string, v interface{}) (interface{}, os.Error) {
+	if len(p.s) < len(lit) || p.s[:len(lit)] != lit {
+		return nil, os.NewError("flagpb: invalid JSON literal")
+	}
+	p.s = p.s[len(lit):]
+	return v, nil
+}
+
+func (p *jsonParser) parseObject() (interface{}, os.Error) {
+	p.s = p.s[1:] // '{'
+	obj := make(map[string]interface{})
+	p.skipSpace()
+	if len(p.s) > 0 && p.s[0] == '}' {
+		p.s = p.s[1:]
+		return obj, nil
+	}
+	for {
+		p.skipSpace()
+		key, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if len(p.s) == 0 || p.s[0] != ':' {
+			return nil, os.NewError("flagpb: expected ':' in JSON object")
+		}
+		p.s = p.s[1:]
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		obj[key.(string)] = val
+		p.skipSpace()
+		if len(p.s) == 0 {
+			return nil, os.NewError("flagpb: unterminated JSON object")
+		}
+		if p.s[0] == ',' {
+			p.s = p.s[1:]
+			continue
+		}
+		if p.s[0] == '}' {
+			p.s = p.s[1:]
+			return obj, nil
+		}
+		return nil, os.NewError("flagpb: expected ',' or '}' in JSON object")
+	}
+}
+
+func (p *jsonParser) parseArray() (interface{}, os.Error) {
+	p.s = p.s[1:] // '['
+	var arr []interface{}
+	p.skipSpace()
+	if len(p.s) > 0 && p.s[0] == ']' {
+		p.s = p.s[1:]
+		return arr, nil
+	}
+	for {
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, val)
+		p.skipSpace()
+		if len(p.s) == 0 {
+			return nil, os.NewError("flagpb: unterminated JSON array")
+		}
+		if p.s[0] == ',' {
+			p.s = p.s[1:]
+			continue
+		}
+		if p.s[0] == ']' {
+			p.s = p.s[1:]
+			return arr, nil
+		}
+		return nil, os.NewError("flagpb: expected ',' or ']' in JSON array")
+	}
+}
+
+func (p *jsonParser) parseString() (interface{}, os.Error) {
+	p.skipSpace()
+	if len(p.s) == 0 || p.s[0] != '"' {
+		return nil, os.NewError("flagpb: expected a JSON string")
+	}
+	i := 1
+	out := make([]byte, 0, len(p.s))
+	for i < len(p.s) && p.s[i] != '"' {
+		c := p.s[i]
+		if c == '\\' && i+1 < len(p.s) {
+			i++
+			switch p.s[i] {
+			case 'n':
+				out = append(out, '\n')
+			case 't':
+				out = append(out, '\t')
+			default:
+				out = append(out, p.s[i])
+			}
+			i++
+			continue
+		}
+		out = append(out, c)
+		i++
+	}
+	if i >= len(p.s) {
+		return nil, os.NewError("flagpb: unterminated JSON string")
+	}
+	p.s = p.s[i+1:]
+	return string(out), nil
+}
+
+func (p *jsonParser) parseNumber() (interface{}, os.Error) {
+	i := 0
+	for i < len(p.s) && isJSONNumberByte(p.s[i]) {
+		i++
+	}
+	if i == 0 {
+		return nil, os.NewError("flagpb: invalid JSON value")
+	}
+	f, err := strconv.Atof64(p.s[:i])
+	if err != nil {
+		return nil, os.NewError("flagpb: invalid JSON number " + p.s[:i])
+	}
+	p.s = p.s[i:]
+	return f, nil
+}
+
+func isJSONNumberByte(c byte) bool {
+	if '0' <= c && c <= '9' {
+		return true
+	}
+	switch c {
+	case '-', '+', '.', 'e', 'E':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,384 @@
+package parser
+
+import (
+	"os"
+	"strconv"
+	"unicode/utf8"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// literalKind identifies which concrete value a literal token decoded to.
+type literalKind int
+
+const (
+	literalString literalKind = iota
+	literalInt
+	literalUint
+	literalFloat
+	literalBool
+	literalIdent // enum value name, or any other bare identifier
+)
+
+// literal is a decoded proto text-format value, as found in a field's
+// "[default = ...]" or in an option's "= ..." right-hand side.
+type literal struct {
+	kind literalKind
+	s    string // decoded bytes, for literalString and literalIdent
+	i    int64
+	u    uint64
+	f    float64
+	b    bool
+}
+
+// readLiteral reads the next token and classifies it as a quoted string,
+// an integer (decimal/hex/octal, signed or unsigned), a float (including
+// inf/-inf/nan), a bool, or a bare identifier.
+func (p *parser) readLiteral() (*literal, *parseError) {
+	tok := p.next()
+	if tok.err != nil {
+		return nil, tok.err
+	}
+	return p.parseLiteralToken(tok.value)
+}
+
+func (p *parser) parseLiteralToken(raw string) (*literal, *parseError) {
+	if isQuoted(raw) {
+		s, err := p.decodeQuoted(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &literal{kind: literalString, s: s}, nil
+	}
+
+	if raw == "true" || raw == "false" {
+		return &literal{kind: literalBool, b: raw == "true"}, nil
+	}
+
+	if lit, ok := parseNumericLiteral(raw); ok {
+		return lit, nil
+	}
+
+	return &literal{kind: literalIdent, s: raw}, nil
+}
+
+// parseNumericLiteral recognizes proto text-format numbers: signed/unsigned
+// decimal, 0x-prefixed hex, 0-prefixed octal integers, floating-point
+// literals, and the special float tokens "inf", "-inf", "+inf" and "nan".
+func parseNumericLiteral(raw string) (*literal, bool) {
+	switch raw {
+	case "inf", "+inf":
+		return &literal{kind: literalFloat, f: inf(1)}, true
+	case "-inf":
+		return &literal{kind: literalFloat, f: inf(-1)}, true
+	case "nan":
+		return &literal{kind: literalFloat, f: nan()}, true
+	}
+
+	neg := false
+	body := raw
+	if len(body) > 0 && (body[0] == '-' || body[0] == '+') {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if body == "" {
+		return nil, false
+	}
+
+	if isIntegerBody(body) {
+		base := 10
+		digits := body
+		if len(digits) > 1 && digits[0] == '0' && (digits[1] == 'x' || digits[1] == 'X') {
+			base = 16
+			digits = digits[2:]
+		} else if len(digits) > 1 && digits[0] == '0' {
+			base = 8
+		}
+		if !neg {
+			if u, err := strconv.Btoui64(digits, base); err == nil {
+				return &literal{kind: literalUint, u: u, i: int64(u)}, true
+			}
+		}
+		if i, err := strconv.Btoi64(digits, base); err == nil {
+			if neg {
+				i = -i
+			}
+			return &literal{kind: literalInt, i: i}, true
+		}
+		return nil, false
+	}
+
+	if f, err := strconv.Atof64(raw); err == nil {
+		return &literal{kind: literalFloat, f: f}, true
+	}
+
+	return nil, false
+}
+
+// isIntegerBody reports whether s (with any sign already stripped) looks
+// like an integer rather than a float: digits, optionally "0x"-prefixed,
+// with no decimal point or exponent.
+func isIntegerBody(s string) bool {
+	if len(s) > 1 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+		if s == "" {
+			return false
+		}
+		for i := 0; i < len(s); i++ {
+			if !isHexDigit(s[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func isHexDigit(c byte) bool {
+	switch {
+	case '0' <= c && c <= '9':
+		return true
+	case 'a' <= c && c <= 'f':
+		return true
+	case 'A' <= c && c <= 'F':
+		return true
+	}
+	return false
+}
+
+func inf(sign int) float64 {
+	var f float64
+	if sign < 0 {
+		f, _ = strconv.Atof64("-1e999999")
+	} else {
+		f, _ = strconv.Atof64("1e999999")
+	}
+	return f
+}
+
+func nan() float64 {
+	f, _ := strconv.Atof64("nan")
+	return f
+}
+
+// decodeQuoted decodes a proto text-format quoted string, including the
+// C-style escapes protoc accepts: \n \t \r \a \b \f \v \\ \' \" \?, octal
+// escapes \ooo (1-3 digits), hex escapes \xHH, and \uXXXX/\UXXXXXXXX
+// Unicode escapes.
+func (p *parser) decodeQuoted(raw string) (string, *parseError) {
+	s := raw[1 : len(raw)-1]
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", p.error("unterminated escape in string literal")
+		}
+		switch s[i] {
+		case 'a':
+			out = append(out, '\a')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case '\\', '\'', '"', '?':
+			out = append(out, s[i])
+		case 'x', 'X':
+			j := i + 1
+			for j < len(s) && j < i+3 && isHexDigit(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				return "", p.error("invalid \\x escape in string literal")
+			}
+			v, _ := strconv.Btoui64(s[i+1:j], 16)
+			out = append(out, byte(v))
+			i = j - 1
+		case 'u', 'U':
+			n := 4
+			if s[i] == 'U' {
+				n = 8
+			}
+			j := i + 1
+			for j < len(s) && j < i+1+n && isHexDigit(s[j]) {
+				j++
+			}
+			if j != i+1+n {
+				return "", p.error("invalid \\u escape in string literal")
+			}
+			v, _ := strconv.Btoui64(s[i+1:j], 16)
+			var buf [utf8.UTFMax]byte
+			nb := utf8.EncodeRune(buf[0:], int(v))
+			out = append(out, buf[:nb]...)
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			v, _ := strconv.Btoui64(s[i:j], 8)
+			out = append(out, byte(v))
+			i = j - 1
+		default:
+			return "", p.error("unknown escape \\%c in string literal", s[i])
+		}
+	}
+	return string(out), nil
+}
+
+// defaultValueString renders a decoded literal as a FieldDescriptorProto
+// DefaultValue string, following the same conventions protoc uses: decimal
+// for integers (range-checked against the field's width), "true"/"false"
+// for bool, the bare identifier for enums, and C-escaped bytes for
+// TYPE_BYTES fields.
+func (lit *literal) defaultValueString(p *parser, ft *FieldDescriptorProto_Type) (string, *parseError) {
+	if ft == nil {
+		// Unresolved message/enum type; the only sensible default is a bare
+		// enum value name, which Resolve will validate later.
+		if lit.kind != literalIdent {
+			return "", p.error("default value must be an enum value name")
+		}
+		return lit.s, nil
+	}
+
+	switch *ft {
+	case FieldDescriptorProto_TYPE_STRING:
+		if lit.kind != literalString {
+			return "", p.error("default value for a string field must be a quoted string")
+		}
+		return lit.s, nil
+	case FieldDescriptorProto_TYPE_BYTES:
+		if lit.kind != literalString {
+			return "", p.error("default value for a bytes field must be a quoted string")
+		}
+		return cEscapeBytes(lit.s), nil
+	case FieldDescriptorProto_TYPE_BOOL:
+		if lit.kind != literalBool {
+			return "", p.error("default value for a bool field must be true or false")
+		}
+		if lit.b {
+			return "true", nil
+		}
+		return "false", nil
+	case FieldDescriptorProto_TYPE_DOUBLE, FieldDescriptorProto_TYPE_FLOAT:
+		switch lit.kind {
+		case literalFloat:
+			return strconv.Ftoa64(lit.f, 'g', -1), nil
+		case literalInt:
+			return strconv.Itoa64(lit.i), nil
+		case literalUint:
+			return strconv.Uitoa64(lit.u), nil
+		}
+		return "", p.error("default value for a floating-point field must be numeric")
+	case FieldDescriptorProto_TYPE_INT32, FieldDescriptorProto_TYPE_INT64,
+		FieldDescriptorProto_TYPE_SINT32, FieldDescriptorProto_TYPE_SINT64,
+		FieldDescriptorProto_TYPE_SFIXED32, FieldDescriptorProto_TYPE_SFIXED64:
+		i, err := lit.asInt64()
+		if err != nil {
+			return "", p.error("%v", err)
+		}
+		if err := checkIntRange(*ft, i); err != nil {
+			return "", p.error("%v", err)
+		}
+		return strconv.Itoa64(i), nil
+	case FieldDescriptorProto_TYPE_UINT32, FieldDescriptorProto_TYPE_UINT64,
+		FieldDescriptorProto_TYPE_FIXED32, FieldDescriptorProto_TYPE_FIXED64:
+		u, err := lit.asUint64()
+		if err != nil {
+			return "", p.error("%v", err)
+		}
+		if err := checkUintRange(*ft, u); err != nil {
+			return "", p.error("%v", err)
+		}
+		return strconv.Uitoa64(u), nil
+	case FieldDescriptorProto_TYPE_ENUM:
+		if lit.kind != literalIdent {
+			return "", p.error("default value for an enum field must be an enum value name")
+		}
+		return lit.s, nil
+	}
+
+	return "", p.error("fields of this type cannot have an explicit default value")
+}
+
+func (lit *literal) asInt64() (int64, os.Error) {
+	switch lit.kind {
+	case literalInt:
+		return lit.i, nil
+	case literalUint:
+		if lit.u > 1<<63-1 {
+			return 0, os.NewError("value out of range for a signed integer")
+		}
+		return int64(lit.u), nil
+	}
+	return 0, os.NewError("default value must be an integer")
+}
+
+func (lit *literal) asUint64() (uint64, os.Error) {
+	switch lit.kind {
+	case literalUint:
+		return lit.u, nil
+	case literalInt:
+		if lit.i < 0 {
+			return 0, os.NewError("value out of range for an unsigned integer")
+		}
+		return uint64(lit.i), nil
+	}
+	return 0, os.NewError("default value must be an integer")
+}
+
+func checkIntRange(ft FieldDescriptorProto_Type, i int64) os.Error {
+	switch ft {
+	case FieldDescriptorProto_TYPE_INT32, FieldDescriptorProto_TYPE_SINT32, FieldDescriptorProto_TYPE_SFIXED32:
+		if i < (-1<<31) || i > (1<<31-1) {
+			return os.NewError("value out of range for a 32-bit integer")
+		}
+	}
+	return nil
+}
+
+func checkUintRange(ft FieldDescriptorProto_Type, u uint64) os.Error {
+	switch ft {
+	case FieldDescriptorProto_TYPE_UINT32, FieldDescriptorProto_TYPE_FIXED32:
+		if u > 1<<32-1 {
+			return os.NewError("value out of range for a 32-bit unsigned integer")
+		}
+	}
+	return nil
+}
+
+// cEscapeBytes renders s the way protoc renders a bytes field's default
+// value: printable ASCII is kept as-is (with quote/backslash escaped), and
+// everything else becomes a 3-digit octal escape.
+func cEscapeBytes(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			out = append(out, '\\', c)
+		case c >= 0x20 && c < 0x7f:
+			out = append(out, c)
+		default:
+			out = append(out, '\\', '0'+(c>>6), '0'+((c>>3)&7), '0'+(c&7))
+		}
+	}
+	return string(out)
+}
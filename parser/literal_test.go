@@ -0,0 +1,116 @@
+package parser
+
+import "testing"
+
+// TestParseLiteralToken covers chunk0-2's typed text-format literal parser:
+// quoted strings, bools, decimal/hex/octal integers, floats and the
+// special inf/nan float tokens, and bare identifiers (enum value names).
+func TestParseLiteralToken(t *testing.T) {
+	p := newParser("")
+
+	cases := []struct {
+		raw  string
+		kind literalKind
+	}{
+		{`"hello"`, literalString},
+		{"true", literalBool},
+		{"false", literalBool},
+		{"42", literalUint},
+		{"-42", literalInt},
+		{"0x2a", literalUint},
+		{"052", literalUint},
+		{"3.14", literalFloat},
+		{"inf", literalFloat},
+		{"-inf", literalFloat},
+		{"nan", literalFloat},
+		{"RED", literalIdent},
+	}
+	for _, c := range cases {
+		lit, err := p.parseLiteralToken(c.raw)
+		if err != nil {
+			t.Errorf("parseLiteralToken(%q): %v", c.raw, err)
+			continue
+		}
+		if lit.kind != c.kind {
+			t.Errorf("parseLiteralToken(%q).kind = %v, want %v", c.raw, lit.kind, c.kind)
+		}
+	}
+
+	lit, err := p.parseLiteralToken("42")
+	if err != nil {
+		t.Fatalf("parseLiteralToken(42): %v", err)
+	}
+	if lit.u != 42 {
+		t.Errorf("42 decoded to u=%d, want 42", lit.u)
+	}
+
+	lit, err = p.parseLiteralToken("0x2a")
+	if err != nil {
+		t.Fatalf("parseLiteralToken(0x2a): %v", err)
+	}
+	if lit.u != 42 {
+		t.Errorf("0x2a decoded to u=%d, want 42", lit.u)
+	}
+
+	lit, err = p.parseLiteralToken("052")
+	if err != nil {
+		t.Fatalf("parseLiteralToken(052): %v", err)
+	}
+	if lit.u != 42 {
+		t.Errorf("052 decoded to u=%d, want 42 (octal)", lit.u)
+	}
+}
+
+// TestDecodeQuotedEscapes covers the C-style escapes decodeQuoted accepts.
+func TestDecodeQuotedEscapes(t *testing.T) {
+	p := newParser("")
+	got, err := p.decodeQuoted(`"a\nb\tc\\d\"e\x41\101"`)
+	if err != nil {
+		t.Fatalf("decodeQuoted: %v", err)
+	}
+	want := "a\nb\tc\\d\"eAA"
+	if got != want {
+		t.Errorf("decodeQuoted = %q, want %q", got, want)
+	}
+}
+
+// TestDefaultValueString covers defaultValueString rendering a decoded
+// literal as the DefaultValue string stored on a FieldDescriptorProto.
+func TestDefaultValueString(t *testing.T) {
+	p := newParser("")
+
+	intType := NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_INT32)
+	lit, err := p.parseLiteralToken("-7")
+	if err != nil {
+		t.Fatalf("parseLiteralToken: %v", err)
+	}
+	s, perr := lit.defaultValueString(p, intType)
+	if perr != nil {
+		t.Fatalf("defaultValueString: %v", perr)
+	}
+	if s != "-7" {
+		t.Errorf("defaultValueString = %q, want -7", s)
+	}
+
+	boolType := NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_BOOL)
+	lit, err = p.parseLiteralToken("true")
+	if err != nil {
+		t.Fatalf("parseLiteralToken: %v", err)
+	}
+	s, perr = lit.defaultValueString(p, boolType)
+	if perr != nil {
+		t.Fatalf("defaultValueString: %v", perr)
+	}
+	if s != "true" {
+		t.Errorf("defaultValueString = %q, want true", s)
+	}
+
+	// An out-of-range default for a 32-bit field must be rejected.
+	lit, err = p.parseLiteralToken("99999999999")
+	if err != nil {
+		t.Fatalf("parseLiteralToken: %v", err)
+	}
+	if _, perr := lit.defaultValueString(p, intType); perr == nil {
+		t.Errorf("defaultValueString(99999999999, int32): got no error, want range error")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"unicode"
 
 	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
@@ -55,9 +56,13 @@ func (pe *parseError) String() string {
 }
 
 type token struct {
-	value        string
-	err          *parseError
-	line, offset int
+	value            string
+	err              *parseError
+	line, offset     int // start position (offset is 0-based from start of input)
+	col              int // start column, 0-based from start of line
+	endLine, endCol  int // end position, exclusive
+	leadingComments  string
+	detachedComments []string
 }
 
 type parser struct {
@@ -65,7 +70,19 @@ type parser struct {
 	done         bool   // whether the parsing is finished
 	backed       bool   // whether back() was called
 	offset, line int
-	cur          token
+	lineStart    int // byte offset where the current line begins
+
+	// Comment bookkeeping for SourceCodeInfo: comments accumulates runs seen
+	// since the last token, and commentGapBlank records whether a blank line
+	// separates the final one from the token about to be read.
+	comments        []commentRun
+	commentGapBlank bool
+
+	cur token
+
+	// fd tracks the file currently being parsed, for SourceCodeInfo
+	// emission; see startLocation in sourceinfo.go.
+	fd *FileDescriptorProto
 }
 
 func newParser(s string) *parser {
@@ -79,6 +96,7 @@ func newParser(s string) *parser {
 }
 
 func (p *parser) readFile(fd *FileDescriptorProto) *parseError {
+	p.fd = fd
 	// Parse the top-level things.
 	for !p.done {
 		tok := p.next()
@@ -86,6 +104,22 @@ func (p *parser) readFile(fd *FileDescriptorProto) *parseError {
 			return tok.err
 		}
 		switch tok.value {
+		case "syntax":
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			tok := p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+			syn := unquoteSimple(tok.value)
+			if syn != "proto2" && syn != "proto3" {
+				return p.error("unknown syntax %q", syn)
+			}
+			fd.Syntax = proto.String(syn)
+			if err := p.readToken(";"); err != nil {
+				return err
+			}
 		case "package":
 			tok := p.next()
 			if tok.err != nil {
@@ -97,14 +131,51 @@ func (p *parser) readFile(fd *FileDescriptorProto) *parseError {
 			if err := p.readToken(";"); err != nil {
 				return err
 			}
+		case "import":
+			p.back()
+			if err := p.readImport(fd); err != nil {
+				return err
+			}
+		case "option":
+			if err := p.readOptionStatement(func(uo *UninterpretedOption) {
+				if fd.Options == nil {
+					fd.Options = new(FileOptions)
+				}
+				fd.Options.UninterpretedOption = append(fd.Options.UninterpretedOption, uo)
+			}); err != nil {
+				return err
+			}
 		case "message":
 			p.back()
 			msg := new(DescriptorProto)
+			idx := int32(len(fd.MessageType))
 			fd.MessageType = append(fd.MessageType, msg)
-			if err := p.readMessage(msg); err != nil {
+			if err := p.readMessage(msg, []int32{fileMessageTypeField, idx}); err != nil {
 				return err
 			}
-		// TODO: more top-level things
+		case "enum":
+			p.back()
+			enum := new(EnumDescriptorProto)
+			idx := int32(len(fd.EnumType))
+			fd.EnumType = append(fd.EnumType, enum)
+			if err := p.readEnum(enum, []int32{fileEnumTypeField, idx}); err != nil {
+				return err
+			}
+		case "extend":
+			p.back()
+			if err := p.readExtend(&fd.Extension); err != nil {
+				return err
+			}
+		case "service":
+			p.back()
+			svc := new(ServiceDescriptorProto)
+			idx := int32(len(fd.Service))
+			fd.Service = append(fd.Service, svc)
+			if err := p.readService(svc, []int32{fileServiceField, idx}); err != nil {
+				return err
+			}
+		case ";":
+			// stray top-level semicolon; harmless
 		case "":
 			// EOF
 			break
@@ -113,58 +184,652 @@ func (p *parser) readFile(fd *FileDescriptorProto) *parseError {
 		}
 	}
 
-	// TODO: more
-
-	return nil
-}
-
-func (p *parser) readMessage(d *DescriptorProto) *parseError {
-	if err := p.readToken("message"); err != nil {
+	return nil
+}
+
+func (p *parser) readImport(fd *FileDescriptorProto) *parseError {
+	if err := p.readToken("import"); err != nil {
+		return err
+	}
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	public, weak := false, false
+	switch tok.value {
+	case "public":
+		public = true
+		tok = p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+	case "weak":
+		weak = true
+		tok = p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+	}
+
+	path := unquoteSimple(tok.value)
+	idx := int32(len(fd.Dependency))
+	fd.Dependency = append(fd.Dependency, path)
+	if public {
+		fd.PublicDependency = append(fd.PublicDependency, idx)
+	}
+	if weak {
+		fd.WeakDependency = append(fd.WeakDependency, idx)
+	}
+
+	return p.readToken(";")
+}
+
+func (p *parser) readMessage(d *DescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
+	}
+	if start.value != "message" {
+		return p.error("expected %q, found %q", "message", start.value)
+	}
+	loc := p.startLocation(path, start, start.comments())
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	// TODO: check that the name is acceptable.
+	d.Name = proto.String(tok.value)
+
+	end, err := p.readMessageBody(d, path)
+	if err != nil {
+		return err
+	}
+	loc.finish(p, end)
+	return nil
+}
+
+// readMessageBody reads the "{ ... }" contents of a message, assuming the
+// "message Name" header (if any) has already been consumed; it is also used
+// for the synthetic message backing a "group" field, which has no header. It
+// returns the closing "}" token, so callers that build a Location spanning
+// the whole message (rather than just its body) can finish it themselves.
+func (p *parser) readMessageBody(d *DescriptorProto, path []int32) (*token, *parseError) {
+	if err := p.readToken("{"); err != nil {
+		return nil, err
+	}
+
+	// Parse message fields and other things inside messages.
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return nil, tok.err
+		}
+		switch tok.value {
+		case "required", "optional", "repeated":
+			p.back()
+			f := new(FieldDescriptorProto)
+			idx := int32(len(d.Field))
+			d.Field = append(d.Field, f)
+			if err := p.readField(d, f, append(path, messageFieldField, idx)); err != nil {
+				return nil, err
+			}
+		case "map":
+			p.back()
+			f := new(FieldDescriptorProto)
+			idx := int32(len(d.Field))
+			d.Field = append(d.Field, f)
+			if err := p.readMapField(d, f, append(path, messageFieldField, idx)); err != nil {
+				return nil, err
+			}
+		case "oneof":
+			p.back()
+			if err := p.readOneof(d, path); err != nil {
+				return nil, err
+			}
+		case "message":
+			p.back()
+			msg := new(DescriptorProto)
+			idx := int32(len(d.NestedType))
+			d.NestedType = append(d.NestedType, msg)
+			if err := p.readMessage(msg, append(path, messageNestedTypeField, idx)); err != nil {
+				return nil, err
+			}
+		case "enum":
+			p.back()
+			enum := new(EnumDescriptorProto)
+			idx := int32(len(d.EnumType))
+			d.EnumType = append(d.EnumType, enum)
+			if err := p.readEnum(enum, append(path, messageEnumTypeField, idx)); err != nil {
+				return nil, err
+			}
+		case "extend":
+			p.back()
+			if err := p.readExtend(&d.Extension); err != nil {
+				return nil, err
+			}
+		case "extensions":
+			p.back()
+			if err := p.readExtensions(d); err != nil {
+				return nil, err
+			}
+		case "reserved":
+			p.back()
+			if err := p.readReserved(d); err != nil {
+				return nil, err
+			}
+		case "option":
+			if err := p.readOptionStatement(func(uo *UninterpretedOption) {
+				if d.Options == nil {
+					d.Options = new(MessageOptions)
+				}
+				d.Options.UninterpretedOption = append(d.Options.UninterpretedOption, uo)
+			}); err != nil {
+				return nil, err
+			}
+		case ";":
+			// stray semicolon; harmless
+		case "}":
+			// end of message
+			return tok, nil
+		default:
+			// proto3 allows the label to be omitted on scalar/message/enum
+			// typed fields, so anything else here is assumed to start one.
+			p.back()
+			f := new(FieldDescriptorProto)
+			idx := int32(len(d.Field))
+			d.Field = append(d.Field, f)
+			if err := p.readField(d, f, append(path, messageFieldField, idx)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, p.error("unexpected end while parsing message")
+}
+
+func (p *parser) readEnum(e *EnumDescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
+	}
+	if start.value != "enum" {
+		return p.error("expected %q, found %q", "enum", start.value)
+	}
+	loc := p.startLocation(path, start, start.comments())
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	e.Name = proto.String(tok.value)
+
+	if err := p.readToken("{"); err != nil {
+		return err
+	}
+
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		switch tok.value {
+		case "}":
+			loc.finish(p, tok)
+			return nil
+		case "option":
+			if err := p.readOptionStatement(func(uo *UninterpretedOption) {
+				if e.Options == nil {
+					e.Options = new(EnumOptions)
+				}
+				e.Options.UninterpretedOption = append(e.Options.UninterpretedOption, uo)
+			}); err != nil {
+				return err
+			}
+		case "reserved":
+			p.back()
+			if err := p.readReserved(nil); err != nil {
+				return err
+			}
+		case ";":
+			// stray semicolon; harmless
+		default:
+			v := new(EnumValueDescriptorProto)
+			idx := int32(len(e.Value))
+			valLoc := p.startLocation(append(path, enumValueField, idx), tok, tok.comments())
+			v.Name = proto.String(tok.value)
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			num, err := p.readTagNumber()
+			if err != nil {
+				return err
+			}
+			v.Number = proto.Int32(num)
+
+			tok := p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+			if tok.value == "[" {
+				p.back()
+				if err := p.readValueOptionList(func(uo *UninterpretedOption) {
+					if v.Options == nil {
+						v.Options = new(EnumValueOptions)
+					}
+					v.Options.UninterpretedOption = append(v.Options.UninterpretedOption, uo)
+				}); err != nil {
+					return err
+				}
+				tok = p.next()
+				if tok.err != nil {
+					return tok.err
+				}
+				if tok.value != ";" {
+					return p.error("expected \";\", found %q", tok.value)
+				}
+			} else if tok.value != ";" {
+				return p.error("expected \";\" or \"[\", found %q", tok.value)
+			}
+			valLoc.finish(p, tok)
+
+			e.Value = append(e.Value, v)
+		}
+	}
+
+	return p.error("unexpected end while parsing enum")
+}
+
+// readOneof does not build its own SourceCodeInfo Location for the
+// OneofDescriptorProto itself (messageOneofDeclField is reserved for that,
+// left as a TODO); its fields are still located as ordinary message fields.
+func (p *parser) readOneof(d *DescriptorProto, path []int32) *parseError {
+	if err := p.readToken("oneof"); err != nil {
+		return err
+	}
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	index := int32(len(d.OneofDecl))
+	d.OneofDecl = append(d.OneofDecl, &OneofDescriptorProto{
+		Name: proto.String(tok.value),
+	})
+
+	if err := p.readToken("{"); err != nil {
+		return err
+	}
+
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		if tok.value == "}" {
+			return nil
+		}
+		if tok.value == ";" {
+			continue
+		}
+		p.back()
+		f := new(FieldDescriptorProto)
+		f.OneofIndex = proto.Int32(index)
+		idx := int32(len(d.Field))
+		d.Field = append(d.Field, f)
+		if err := p.readFieldBody(d, f, append(path, messageFieldField, idx)); err != nil {
+			return err
+		}
+	}
+
+	return p.error("unexpected end while parsing oneof")
+}
+
+func (p *parser) readExtend(extension *[]*FieldDescriptorProto) *parseError {
+	if err := p.readToken("extend"); err != nil {
+		return err
+	}
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	extendee := tok.value
+
+	if err := p.readToken("{"); err != nil {
+		return err
+	}
+
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		switch tok.value {
+		case "}":
+			return nil
+		case ";":
+			continue
+		case "required", "optional", "repeated":
+			p.back()
+			f := new(FieldDescriptorProto)
+			f.Extendee = proto.String(extendee)
+			if err := p.readField(nil, f, nil); err != nil {
+				return err
+			}
+			if f.GetType() == FieldDescriptorProto_TYPE_GROUP {
+				// A group field desugars to a synthetic nested message, but
+				// extend has no DescriptorProto of its own to hold it (it
+				// isn't the extendee's message, which lives in another
+				// scope entirely, possibly another file) and d is passed as
+				// nil into readField above, so the message readGroupField
+				// just parsed would otherwise be silently discarded. Reject
+				// it outright rather than emit a FieldDescriptorProto whose
+				// TypeName can never resolve.
+				return p.error("group fields are not supported inside extend blocks")
+			}
+			*extension = append(*extension, f)
+		default:
+			return p.error("unexpected token %q while parsing extend block", tok.value)
+		}
+	}
+
+	return p.error("unexpected end while parsing extend")
+}
+
+func (p *parser) readExtensions(d *DescriptorProto) *parseError {
+	if err := p.readToken("extensions"); err != nil {
+		return err
+	}
+
+	for {
+		start, err := p.readTagNumber()
+		if err != nil {
+			return err
+		}
+		end := start
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		if tok.value == "to" {
+			tok = p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+			if tok.value == "max" {
+				end = 1<<29 - 1 // matches the max allowed field number
+			} else {
+				e, err := atoi32(tok.value)
+				if err != nil {
+					return p.error("bad extensions range end %q: %v", tok.value, err)
+				}
+				end = e
+			}
+			tok = p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+		}
+		d.ExtensionRange = append(d.ExtensionRange, &DescriptorProto_ExtensionRange{
+			Start: proto.Int32(start),
+			End:   proto.Int32(end + 1), // end is exclusive in the descriptor
+		})
+		if tok.value == "," {
+			continue
+		}
+		if tok.value == ";" {
+			return nil
+		}
+		return p.error("expected \",\" or \";\", found %q", tok.value)
+	}
+}
+
+func (p *parser) readTagNumber() (int32, *parseError) {
+	tok := p.next()
+	if tok.err != nil {
+		return 0, tok.err
+	}
+	n, err := atoi32(tok.value)
+	if err != nil {
+		return 0, p.error("bad tag number %q: %v", tok.value, err)
+	}
+	return n, nil
+}
+
+func (p *parser) readReserved(d *DescriptorProto) *parseError {
+	if err := p.readToken("reserved"); err != nil {
+		return err
+	}
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+
+	if isQuoted(tok.value) {
+		// reserved "foo", "bar";
+		for {
+			name := unquoteSimple(tok.value)
+			if d != nil {
+				d.ReservedName = append(d.ReservedName, name)
+			}
+			tok = p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+			if tok.value == "," {
+				tok = p.next()
+				if tok.err != nil {
+					return tok.err
+				}
+				continue
+			}
+			break
+		}
+		if tok.value != ";" {
+			return p.error("expected \";\", found %q", tok.value)
+		}
+		return nil
+	}
+
+	// reserved 2, 15, 9 to 11;
+	p.back()
+	for {
+		start, err := p.readTagNumber()
+		if err != nil {
+			return err
+		}
+		end := start
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		if tok.value == "to" {
+			tok = p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+			if tok.value == "max" {
+				end = 1<<29 - 1
+			} else {
+				e, err := atoi32(tok.value)
+				if err != nil {
+					return p.error("bad reserved range end %q: %v", tok.value, err)
+				}
+				end = e
+			}
+			tok = p.next()
+			if tok.err != nil {
+				return tok.err
+			}
+		}
+		if d != nil {
+			d.ReservedRange = append(d.ReservedRange, &DescriptorProto_ReservedRange{
+				Start: proto.Int32(start),
+				End:   proto.Int32(end + 1),
+			})
+		}
+		if tok.value == "," {
+			continue
+		}
+		if tok.value == ";" {
+			return nil
+		}
+		return p.error("expected \",\" or \";\", found %q", tok.value)
+	}
+}
+
+func (p *parser) readService(s *ServiceDescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
+	}
+	if start.value != "service" {
+		return p.error("expected %q, found %q", "service", start.value)
+	}
+	loc := p.startLocation(path, start, start.comments())
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	s.Name = proto.String(tok.value)
+
+	if err := p.readToken("{"); err != nil {
+		return err
+	}
+
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		switch tok.value {
+		case "}":
+			loc.finish(p, tok)
+			return nil
+		case ";":
+			continue
+		case "option":
+			if err := p.readOptionStatement(func(uo *UninterpretedOption) {
+				if s.Options == nil {
+					s.Options = new(ServiceOptions)
+				}
+				s.Options.UninterpretedOption = append(s.Options.UninterpretedOption, uo)
+			}); err != nil {
+				return err
+			}
+		case "rpc":
+			p.back()
+			m := new(MethodDescriptorProto)
+			idx := int32(len(s.Method))
+			s.Method = append(s.Method, m)
+			if err := p.readMethod(m, append(path, serviceMethodField, idx)); err != nil {
+				return err
+			}
+		default:
+			return p.error("unexpected token %q while parsing service", tok.value)
+		}
+	}
+
+	return p.error("unexpected end while parsing service")
+}
+
+func (p *parser) readMethod(m *MethodDescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
+	}
+	if start.value != "rpc" {
+		return p.error("expected %q, found %q", "rpc", start.value)
+	}
+	loc := p.startLocation(path, start, start.comments())
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	m.Name = proto.String(tok.value)
+
+	if err := p.readToken("("); err != nil {
+		return err
+	}
+	tok = p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	if tok.value == "stream" {
+		m.ClientStreaming = proto.Bool(true)
+		tok = p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+	}
+	m.InputType = proto.String(tok.value)
+	if err := p.readToken(")"); err != nil {
+		return err
+	}
+
+	if err := p.readToken("returns"); err != nil {
 		return err
 	}
-
-	tok := p.next()
+	if err := p.readToken("("); err != nil {
+		return err
+	}
+	tok = p.next()
 	if tok.err != nil {
 		return tok.err
 	}
-	// TODO: check that the name is acceptable.
-	d.Name = proto.String(tok.value)
-
-	if err := p.readToken("{"); err != nil {
-		return err
-	}
-
-	// Parse message fields and other things inside messages.
-	for !p.done {
-		tok := p.next()
+	if tok.value == "stream" {
+		m.ServerStreaming = proto.Bool(true)
+		tok = p.next()
 		if tok.err != nil {
 			return tok.err
 		}
-		switch tok.value {
-		case "required", "optional", "repeated":
-			// field
-			p.back()
-			f := new(FieldDescriptorProto)
-			d.Field = append(d.Field, f)
-			if err := p.readField(f); err != nil {
-				return err
+	}
+	m.OutputType = proto.String(tok.value)
+	if err := p.readToken(")"); err != nil {
+		return err
+	}
+
+	tok = p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	switch tok.value {
+	case ";":
+		loc.finish(p, tok)
+		return nil
+	case "{":
+		for !p.done {
+			tok := p.next()
+			if tok.err != nil {
+				return tok.err
 			}
-		case "message":
-			// inner message
-			p.back()
-			msg := new(DescriptorProto)
-			d.NestedType = append(d.NestedType, msg)
-			if err := p.readMessage(msg); err != nil {
-				return err
+			switch tok.value {
+			case "}":
+				loc.finish(p, tok)
+				return nil
+			case ";":
+				continue
+			case "option":
+				if err := p.readOptionStatement(func(uo *UninterpretedOption) {
+					if m.Options == nil {
+						m.Options = new(MethodOptions)
+					}
+					m.Options.UninterpretedOption = append(m.Options.UninterpretedOption, uo)
+				}); err != nil {
+					return err
+				}
+			default:
+				return p.error("unexpected token %q while parsing method body", tok.value)
 			}
-		// TODO: more message contents
-		case "}":
-			// end of message
-			return nil
 		}
+		return p.error("unexpected end while parsing method")
 	}
-
-	return p.error("unexpected end while parsing message")
+	return p.error("expected \";\" or \"{\", found %q", tok.value)
 }
 
 var fieldLabelMap = map[string]*FieldDescriptorProto_Label{
@@ -192,25 +857,58 @@ var fieldTypeMap = map[string]*FieldDescriptorProto_Type{
 	"sint64":   NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_SINT64),
 }
 
-func (p *parser) readField(f *FieldDescriptorProto) *parseError {
-	tok := p.next()
-	if tok.err != nil {
-		return tok.err
+// readField reads a "required/optional/repeated <type> name = N [opts];"
+// field declaration, including the proto2 "group" variant, and attaches any
+// nested group message to d (which may be nil when parsing an extend block).
+func (p *parser) readField(d *DescriptorProto, f *FieldDescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
 	}
-	if lab, ok := fieldLabelMap[tok.value]; ok {
+	if lab, ok := fieldLabelMap[start.value]; ok {
 		f.Label = lab
 	} else {
-		return p.error("expected required/optional/repeated, found %q", tok.value)
+		// proto3 fields may omit the label entirely.
+		f.Label = NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL)
+		p.back()
 	}
 
-	tok = p.next()
+	return p.readFieldBodyFrom(d, f, path, start)
+}
+
+// readFieldBody reads everything after the optional label: the type, name,
+// number and trailing option list. It is used by readOneof, since oneof
+// fields never carry a label; readField, which consumes the label first,
+// calls readFieldBodyFrom directly.
+func (p *parser) readFieldBody(d *DescriptorProto, f *FieldDescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
+	}
+	p.back()
+	return p.readFieldBodyFrom(d, f, path, start)
+}
+
+// readFieldBodyFrom is readFieldBody, but takes the token that should anchor
+// the field's Location (its label if it had one, otherwise its type), since
+// readField has already consumed that token by the time it calls in here.
+func (p *parser) readFieldBodyFrom(d *DescriptorProto, f *FieldDescriptorProto, path []int32, start *token) *parseError {
+	loc := p.startLocation(path, start, start.comments())
+
+	tok := p.next()
 	if tok.err != nil {
 		return tok.err
 	}
+
+	if tok.value == "group" {
+		return p.readGroupField(d, f, loc)
+	}
+
 	if typ, ok := fieldTypeMap[tok.value]; ok {
 		f.Type = typ
 	} else {
-		// TODO: type names need checking; this just guesses it's a message, but it could be an enum.
+		// Could be a message or enum type; semantic resolution (see Resolve)
+		// fills in f.Type and fully-qualifies f.TypeName later.
 		f.TypeName = proto.String(tok.value)
 	}
 
@@ -225,25 +923,336 @@ func (p *parser) readField(f *FieldDescriptorProto) *parseError {
 		return err
 	}
 
+	num, err := p.readTagNumber()
+	if err != nil {
+		return err
+	}
+	f.Number = proto.Int32(num)
+
 	tok = p.next()
 	if tok.err != nil {
 		return tok.err
 	}
-	num, err := atoi32(tok.value)
+	if tok.value == "[" {
+		p.back()
+		if err := p.readFieldOptionList(f); err != nil {
+			return err
+		}
+		tok = p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+	}
+	if tok.value != ";" {
+		return p.error("expected \";\", found %q", tok.value)
+	}
+	loc.finish(p, tok)
+
+	return nil
+}
+
+// readGroupField reads the proto2 "group Name = N { ... }" field form,
+// which desugars to a field of TYPE_GROUP plus a synthetic nested message.
+// loc is the in-progress Location for the field itself, begun by the caller.
+func (p *parser) readGroupField(d *DescriptorProto, f *FieldDescriptorProto, loc *locBuilder) *parseError {
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	groupName := tok.value
+	f.Type = NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_GROUP)
+	f.TypeName = proto.String(groupName)
+	// protoc lower-cases the synthesized field name for groups.
+	f.Name = proto.String(toLower(groupName))
+
+	if err := p.readToken("="); err != nil {
+		return err
+	}
+	num, err := p.readTagNumber()
 	if err != nil {
-		return p.error("bad field number %q: %v", tok.value, err)
+		return err
 	}
 	f.Number = proto.Int32(num)
 
-	// TODO: default value, options
+	msg := &DescriptorProto{Name: proto.String(groupName)}
+	end, err := p.readMessageBody(msg, nil)
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		d.NestedType = append(d.NestedType, msg)
+	}
+	loc.finish(p, end)
+
+	return nil
+}
+
+// readMapField reads "map<KeyType, ValueType> name = N;", desugaring it into
+// a repeated field of a synthetic "FooEntry" message with MapEntry=true, the
+// same transform protoc performs.
+func (p *parser) readMapField(d *DescriptorProto, f *FieldDescriptorProto, path []int32) *parseError {
+	start := p.next()
+	if start.err != nil {
+		return start.err
+	}
+	if start.value != "map" {
+		return p.error("expected %q, found %q", "map", start.value)
+	}
+	loc := p.startLocation(path, start, start.comments())
+	if err := p.readToken("<"); err != nil {
+		return err
+	}
+	keyTok := p.next()
+	if keyTok.err != nil {
+		return keyTok.err
+	}
+	if err := p.readToken(","); err != nil {
+		return err
+	}
+	valTok := p.next()
+	if valTok.err != nil {
+		return valTok.err
+	}
+	if err := p.readToken(">"); err != nil {
+		return err
+	}
+
+	nameTok := p.next()
+	if nameTok.err != nil {
+		return nameTok.err
+	}
+	fieldName := nameTok.value
 
-	if err := p.readToken(";"); err != nil {
+	if err := p.readToken("="); err != nil {
+		return err
+	}
+	num, err := p.readTagNumber()
+	if err != nil {
 		return err
 	}
 
+	entryName := mapEntryName(fieldName)
+	keyField := &FieldDescriptorProto{
+		Name:   proto.String("key"),
+		Number: proto.Int32(1),
+		Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+	}
+	if typ, ok := fieldTypeMap[keyTok.value]; ok {
+		keyField.Type = typ
+	} else {
+		return p.error("invalid map key type %q", keyTok.value)
+	}
+	valField := &FieldDescriptorProto{
+		Name:   proto.String("value"),
+		Number: proto.Int32(2),
+		Label:  NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+	}
+	if typ, ok := fieldTypeMap[valTok.value]; ok {
+		valField.Type = typ
+	} else {
+		valField.TypeName = proto.String(valTok.value)
+	}
+
+	entry := &DescriptorProto{
+		Name:    proto.String(entryName),
+		Field:   []*FieldDescriptorProto{keyField, valField},
+		Options: &MessageOptions{MapEntry: proto.Bool(true)},
+	}
+	d.NestedType = append(d.NestedType, entry)
+
+	f.Name = proto.String(fieldName)
+	f.Number = proto.Int32(num)
+	f.Label = NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_REPEATED)
+	f.Type = NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE)
+	f.TypeName = proto.String(entryName)
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	if tok.value == "[" {
+		p.back()
+		if err := p.readFieldOptionList(f); err != nil {
+			return err
+		}
+		tok = p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+	}
+	if tok.value != ";" {
+		return p.error("expected \";\", found %q", tok.value)
+	}
+	loc.finish(p, tok)
+
 	return nil
 }
 
+// readFieldOptionList reads "[ name = value, ... ]" after a field
+// declaration, recognizing "default" and "deprecated"/"packed" specially and
+// recording everything else as an UninterpretedOption.
+func (p *parser) readFieldOptionList(f *FieldDescriptorProto) *parseError {
+	if err := p.readToken("["); err != nil {
+		return err
+	}
+	for {
+		name, isExt, err := p.readOptionName()
+		if err != nil {
+			return err
+		}
+		if err := p.readToken("="); err != nil {
+			return err
+		}
+		lit, err := p.readLiteral()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !isExt && name == "default":
+			dv, err := lit.defaultValueString(p, f.Type)
+			if err != nil {
+				return err
+			}
+			f.DefaultValue = proto.String(dv)
+		case !isExt && name == "deprecated":
+			if f.Options == nil {
+				f.Options = new(FieldOptions)
+			}
+			f.Options.Deprecated = proto.Bool(lit.kind == literalBool && lit.b)
+		case !isExt && name == "packed":
+			if f.Options == nil {
+				f.Options = new(FieldOptions)
+			}
+			f.Options.Packed = proto.Bool(lit.kind == literalBool && lit.b)
+		default:
+			if f.Options == nil {
+				f.Options = new(FieldOptions)
+			}
+			f.Options.UninterpretedOption = append(f.Options.UninterpretedOption, newUninterpretedOption(name, isExt, lit))
+		}
+
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		if tok.value == "," {
+			continue
+		}
+		if tok.value == "]" {
+			return nil
+		}
+		return p.error("expected \",\" or \"]\", found %q", tok.value)
+	}
+}
+
+// readValueOptionList reads a bracketed option list whose entries are all
+// reported generically, for constructs (like enum values) that don't have
+// special-cased option names.
+func (p *parser) readValueOptionList(add func(*UninterpretedOption)) *parseError {
+	if err := p.readToken("["); err != nil {
+		return err
+	}
+	for {
+		name, isExt, err := p.readOptionName()
+		if err != nil {
+			return err
+		}
+		if err := p.readToken("="); err != nil {
+			return err
+		}
+		lit, err := p.readLiteral()
+		if err != nil {
+			return err
+		}
+		add(newUninterpretedOption(name, isExt, lit))
+
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		if tok.value == "," {
+			continue
+		}
+		if tok.value == "]" {
+			return nil
+		}
+		return p.error("expected \",\" or \"]\", found %q", tok.value)
+	}
+}
+
+// readOptionStatement reads a top-level "option name = value;" statement.
+func (p *parser) readOptionStatement(add func(*UninterpretedOption)) *parseError {
+	name, isExt, err := p.readOptionName()
+	if err != nil {
+		return err
+	}
+	if err := p.readToken("="); err != nil {
+		return err
+	}
+	lit, err := p.readLiteral()
+	if err != nil {
+		return err
+	}
+	add(newUninterpretedOption(name, isExt, lit))
+	return p.readToken(";")
+}
+
+// readOptionName reads a (possibly dotted, possibly parenthesized-extension)
+// option name, e.g. "foo", "foo.bar", "(my.custom_option)". Nothing after an
+// extension name's closing parenthesis is read, so a sub-field path such as
+// "(my.custom_option).bar" is not accepted.
+func (p *parser) readOptionName() (name string, isExtension bool, perr *parseError) {
+	tok := p.next()
+	if tok.err != nil {
+		return "", false, tok.err
+	}
+	if tok.value == "(" {
+		isExtension = true
+		tok = p.next()
+		if tok.err != nil {
+			return "", false, tok.err
+		}
+		name = tok.value
+		if err := p.readToken(")"); err != nil {
+			return "", false, err
+		}
+	} else {
+		name = tok.value
+	}
+	return name, isExtension, nil
+}
+
+func newUninterpretedOption(name string, isExtension bool, lit *literal) *UninterpretedOption {
+	uo := &UninterpretedOption{
+		Name: []*UninterpretedOption_NamePart{
+			{
+				NamePart:    proto.String(name),
+				IsExtension: proto.Bool(isExtension),
+			},
+		},
+	}
+	switch lit.kind {
+	case literalString:
+		uo.StringValue = []byte(lit.s)
+	case literalInt:
+		uo.NegativeIntValue = proto.Int64(lit.i)
+	case literalUint:
+		uo.PositiveIntValue = proto.Uint64(lit.u)
+	case literalFloat:
+		uo.DoubleValue = proto.Float64(lit.f)
+	case literalBool:
+		if lit.b {
+			uo.IdentifierValue = proto.String("true")
+		} else {
+			uo.IdentifierValue = proto.String("false")
+		}
+	case literalIdent:
+		uo.IdentifierValue = proto.String(lit.s)
+	}
+	return uo
+}
+
 func (p *parser) readToken(expected string) *parseError {
 	tok := p.next()
 	if tok.err != nil {
@@ -275,7 +1284,8 @@ func (p *parser) next() *token {
 }
 
 func (p *parser) advance() {
-	// Skip whitespace
+	// Skip whitespace and comments, buffering any comments we pass over so
+	// the next token can claim them (see claimComments).
 	p.skipWhitespaceAndComments()
 	if p.done {
 		return
@@ -284,11 +1294,16 @@ func (p *parser) advance() {
 	// Start of non-whitespace
 	p.cur.err = nil
 	p.cur.offset, p.cur.line = p.offset, p.line
+	p.cur.col = p.offset - p.lineStart
+	p.cur.leadingComments, p.cur.detachedComments = p.claimComments()
 	switch p.s[0] {
-	// TODO: more cases, like punctuation.
-	case ';', '{', '}', '=':
+	case ';', '{', '}', '=', '(', ')', '[', ']', '<', '>', ',', ':':
 		// Single symbol
 		p.cur.value, p.s = p.s[:1], p.s[1:]
+	case '"', '\'':
+		if !p.readQuoted() {
+			return
+		}
 	default:
 		i := 0
 		for i < len(p.s) && isIdentOrNumberChar(p.s[i]) {
@@ -301,33 +1316,136 @@ func (p *parser) advance() {
 		p.cur.value, p.s = p.s[:i], p.s[i:]
 	}
 	p.offset += len(p.cur.value)
+	p.cur.endLine, p.cur.endCol = p.cur.line, p.offset-p.lineStart
+}
+
+// commentRun is one contiguous run of "//" or "/* */" comments encountered
+// between two tokens.
+type commentRun struct {
+	text        string
+	blankBefore bool // a blank line separates this run from whatever precedes it
+}
+
+// claimComments hands back the comments buffered by the most recent
+// skipWhitespaceAndComments call, split into the run immediately adjacent to
+// the upcoming token (its leading comment) and any earlier runs that are
+// separated from it by a blank line (detached comments). If a blank line
+// separates even the last run from the token, there is no leading comment at
+// all and every run is detached.
+func (p *parser) claimComments() (leading string, detached []string) {
+	runs := p.comments
+	p.comments = nil
+	if len(runs) == 0 {
+		return "", nil
+	}
+	last := runs[len(runs)-1]
+	if p.commentGapBlank {
+		for _, r := range runs {
+			detached = append(detached, r.text)
+		}
+		return "", detached
+	}
+	for _, r := range runs[:len(runs)-1] {
+		detached = append(detached, r.text)
+	}
+	return last.text, detached
+}
+
+// readQuoted scans a single- or double-quoted string literal, leaving the
+// surrounding quote characters in p.cur.value so callers can tell it was a
+// string (see isQuoted/unquoteSimple). Backslash escapes are not interpreted
+// here, only skipped over so an escaped quote doesn't end the literal early.
+func (p *parser) readQuoted() bool {
+	quote := p.s[0]
+	i := 1
+	for i < len(p.s) && p.s[i] != quote {
+		if p.s[i] == '\\' && i+1 < len(p.s) {
+			i++
+		}
+		if p.s[i] == '\n' {
+			p.error("unterminated string literal")
+			return false
+		}
+		i++
+	}
+	if i >= len(p.s) {
+		p.error("unterminated string literal")
+		return false
+	}
+	i++ // include closing quote
+	p.cur.value, p.s = p.s[:i], p.s[i:]
+	return true
 }
 
 func (p *parser) skipWhitespaceAndComments() {
+	base := p.offset
 	i := 0
+	newlineRun := 0 // consecutive blank lines since the last comment/content
+	var curRun []string
+	curRunBlankBefore := false
+
+	flush := func() {
+		if len(curRun) > 0 {
+			p.comments = append(p.comments, commentRun{
+				text:        strings.Join(curRun, "\n"),
+				blankBefore: curRunBlankBefore,
+			})
+			curRun = nil
+			curRunBlankBefore = false
+		}
+	}
+
 	for i < len(p.s) {
-		if isWhitespace(p.s[i]) {
-			if p.s[i] == '\n' {
-				p.line++
+		c := p.s[i]
+		if c == '\n' {
+			p.line++
+			p.lineStart = base + i + 1
+			newlineRun++
+			if newlineRun >= 2 {
+				flush()
+				curRunBlankBefore = true
 			}
 			i++
 			continue
 		}
-		if i+1 < len(p.s) && p.s[i] == '/' && p.s[i+1] == '/' {
-			// comment; skip to end of line or input
+		if isWhitespace(c) {
+			i++
+			continue
+		}
+		if i+1 < len(p.s) && c == '/' && p.s[i+1] == '/' {
+			start := i + 2
 			for i < len(p.s) && p.s[i] != '\n' {
 				i++
 			}
-			if i < len(p.s) {
-				// end of line; keep going
-				p.line++
-				i++
-				continue
+			curRun = append(curRun, strings.TrimSpace(p.s[start:i]))
+			newlineRun = 0
+			continue
+		}
+		if i+1 < len(p.s) && c == '/' && p.s[i+1] == '*' {
+			start := i + 2
+			end := start
+			for end+1 < len(p.s) && !(p.s[end] == '*' && p.s[end+1] == '/') {
+				if p.s[end] == '\n' {
+					p.line++
+					p.lineStart = base + end + 1
+				}
+				end++
+			}
+			if end+1 >= len(p.s) {
+				// unterminated; let the caller hit EOF naturally
+				i = len(p.s)
+				break
 			}
-			// end of input; fall out of loop
+			curRun = append(curRun, strings.TrimSpace(p.s[start:end]))
+			i = end + 2
+			newlineRun = 0
+			continue
 		}
 		break
 	}
+	flush()
+	p.commentGapBlank = newlineRun >= 2
+
 	p.offset += i
 	p.s = p.s[i:]
 	if len(p.s) == 0 {
@@ -366,13 +1484,81 @@ func isIdentOrNumberChar(c byte) bool {
 	return false
 }
 
+// isQuoted reports whether a token value is a string literal, i.e. still has
+// its surrounding quote characters (see parser.readQuoted).
+func isQuoted(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	return (s[0] == '"' && s[len(s)-1] == '"') || (s[0] == '\'' && s[len(s)-1] == '\'')
+}
+
+// unquoteSimple strips surrounding quotes and decodes the small set of
+// escapes a bare string token can contain. Full proto text-format escape
+// handling (octal, hex, unicode) belongs to the literal parser, not here.
+func unquoteSimple(s string) string {
+	if !isQuoted(s) {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				out = append(out, '\n')
+			case 't':
+				out = append(out, '\t')
+			case 'r':
+				out = append(out, '\r')
+			default:
+				out = append(out, s[i])
+			}
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+func toLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+// mapEntryName produces the synthetic nested message name protoc uses for a
+// desugared map field, e.g. "tags" -> "TagsEntry".
+func mapEntryName(fieldName string) string {
+	upperNext := true
+	out := make([]byte, 0, len(fieldName)+5)
+	for i := 0; i < len(fieldName); i++ {
+		c := fieldName[i]
+		if c == '_' {
+			upperNext = true
+			continue
+		}
+		if upperNext && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upperNext = false
+		out = append(out, c)
+	}
+	return string(out) + "Entry"
+}
+
 func atoi32(s string) (int32, os.Error) {
 	x, err := strconv.Atoi64(s)
 	if err != nil {
 		return 0, err
 	}
-	if x < (-1 << 31) || x > (1<<31 - 1) {
+	if x < (-1<<31) || x > (1<<31-1) {
 		return 0, os.NewError("out of int32 range")
 	}
 	return int32(x), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,151 @@
+package parser
+
+import (
+	"testing"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+	"goprotobuf.googlecode.com/hg/proto"
+)
+
+const goldenProto = `
+syntax = "proto3";
+
+package golden;
+
+// Color enumerates the colors a Shape can have.
+enum Color {
+	RED = 0;
+	GREEN = 1;
+}
+
+// Shape is a simple named, colored shape.
+message Shape {
+	string name = 1;
+	Color color = 2;
+	repeated double points = 3 [packed = true];
+
+	oneof payload {
+		string label = 4;
+		int32 count = 5;
+	}
+
+	map<string, int32> tags = 6;
+}
+
+service Shapes {
+	rpc Describe (Shape) returns (Shape);
+}
+`
+
+func parseGolden(t *testing.T) *FileDescriptorProto {
+	fd := &FileDescriptorProto{Name: proto.String("golden.proto")}
+	p := newParser(goldenProto)
+	if err := p.readFile(fd); err != nil {
+		t.Fatalf("readFile: %v", err)
+	}
+	if p.s != "" {
+		t.Fatalf("input not fully consumed, left: %q", p.s)
+	}
+	return fd
+}
+
+// TestParseShapeMessage is a golden test covering the bulk of the grammar
+// chunk0-1 added: a proto3 file with an enum, a message mixing a plain
+// field, an enum-typed field, a packed repeated scalar, a oneof and a map
+// field, and a service with one method.
+func TestParseShapeMessage(t *testing.T) {
+	fd := parseGolden(t)
+
+	if fd.GetSyntax() != "proto3" {
+		t.Fatalf("syntax = %q, want proto3", fd.GetSyntax())
+	}
+	if fd.GetPackage() != "golden" {
+		t.Fatalf("package = %q, want golden", fd.GetPackage())
+	}
+
+	if len(fd.MessageType) != 1 {
+		t.Fatalf("got %d top-level messages, want 1 (map fields nest their entry message, not hoist it to the top level)", len(fd.MessageType))
+	}
+	shape := fd.MessageType[0]
+	if shape.GetName() != "Shape" {
+		t.Fatalf("message[0] = %q, want Shape", shape.GetName())
+	}
+
+	wantFields := []struct {
+		name   string
+		number int32
+	}{
+		{"name", 1},
+		{"color", 2},
+		{"points", 3},
+		{"label", 4},
+		{"count", 5},
+		{"tags", 6},
+	}
+	if len(shape.Field) != len(wantFields) {
+		t.Fatalf("got %d fields, want %d", len(shape.Field), len(wantFields))
+	}
+	for i, want := range wantFields {
+		f := shape.Field[i]
+		if f.GetName() != want.name || f.GetNumber() != want.number {
+			t.Errorf("field[%d] = %s/%d, want %s/%d", i, f.GetName(), f.GetNumber(), want.name, want.number)
+		}
+	}
+
+	if len(shape.OneofDecl) != 1 || shape.OneofDecl[0].GetName() != "payload" {
+		t.Fatalf("oneof_decl = %+v, want one oneof named payload", shape.OneofDecl)
+	}
+	if got := shape.Field[3].GetOneofIndex(); got != 0 {
+		t.Errorf("label.oneof_index = %d, want 0", got)
+	}
+	if got := shape.Field[4].GetOneofIndex(); got != 0 {
+		t.Errorf("count.oneof_index = %d, want 0", got)
+	}
+
+	points := shape.Field[2]
+	if points.GetLabel() != FieldDescriptorProto_LABEL_REPEATED {
+		t.Errorf("points.label = %v, want repeated", points.GetLabel())
+	}
+	if !points.GetOptions().GetPacked() {
+		t.Errorf("points should be [packed = true]")
+	}
+
+	if len(shape.NestedType) != 1 || shape.NestedType[0].GetName() != "TagsEntry" {
+		t.Fatalf("nested_type = %+v, want one synthetic TagsEntry message", shape.NestedType)
+	}
+	if !shape.NestedType[0].GetOptions().GetMapEntry() {
+		t.Errorf("TagsEntry should have map_entry = true")
+	}
+
+	if len(fd.EnumType) != 1 || fd.EnumType[0].GetName() != "Color" {
+		t.Fatalf("enum_type = %+v, want one enum named Color", fd.EnumType)
+	}
+	if len(fd.EnumType[0].Value) != 2 {
+		t.Fatalf("Color has %d values, want 2", len(fd.EnumType[0].Value))
+	}
+
+	if len(fd.Service) != 1 || fd.Service[0].GetName() != "Shapes" {
+		t.Fatalf("service = %+v, want one service named Shapes", fd.Service)
+	}
+	if len(fd.Service[0].Method) != 1 || fd.Service[0].Method[0].GetName() != "Describe" {
+		t.Fatalf("method = %+v, want one method named Describe", fd.Service[0].Method)
+	}
+}
+
+// TestReadExtendRejectsGroup covers the chunk0-1 fix: a group field inside
+// an extend block has no container to hold its synthesized nested message,
+// so it must be rejected rather than silently parsed and discarded.
+func TestReadExtendRejectsGroup(t *testing.T) {
+	const src = `
+		extend Foo {
+			optional group Bar = 10 {
+				optional string x = 1;
+			}
+		}
+	`
+	p := newParser(src)
+	var ext []*FieldDescriptorProto
+	if err := p.readExtend(&ext); err == nil {
+		t.Fatalf("readExtend with a group field: got no error, want one")
+	}
+}
@@ -0,0 +1,367 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+	"goprotobuf.googlecode.com/hg/proto"
+)
+
+// resolveError reports a problem found while resolving type names across a
+// FileDescriptorSet, in the same vein as parseError reports a syntax problem
+// within a single file.
+type resolveError struct {
+	message string
+}
+
+func (re *resolveError) String() string {
+	if re == nil {
+		return "<nil>"
+	}
+	return re.message
+}
+
+func resolveErrorf(format string, a ...interface{}) *resolveError {
+	return &resolveError{message: fmt.Sprintf(format, a...)}
+}
+
+type symbolKind int
+
+const (
+	symbolMessage symbolKind = iota
+	symbolEnum
+)
+
+// symbol is an entry in the cross-file table built by buildSymbolTable,
+// keyed by a type's fully-qualified (leading-dot) name.
+type symbol struct {
+	kind symbolKind
+	file string // name of the FileDescriptorProto that declares this type
+	fq   string // the same fully-qualified name this symbol is keyed under
+	msg  *DescriptorProto
+	enum *EnumDescriptorProto
+}
+
+// Resolve walks every FieldDescriptorProto.TypeName (and Extendee) in fds
+// and rewrites it to its fully-qualified form, filling in Type with
+// TYPE_MESSAGE or TYPE_ENUM as appropriate. Names are resolved using
+// proto's usual scoping rules: the current message, then each enclosing
+// scope, then the file's package and each shorter prefix of it (see
+// packageScopes), then the package-less root, restricted at
+// each step to the types visible to the referencing file (itself, its
+// direct imports, and those imports' "public" re-exports).
+//
+// Resolve also rejects required-field cycles, since no message value could
+// ever be constructed for them.
+func Resolve(fds *FileDescriptorSet) os.Error {
+	byName := make(map[string]*FileDescriptorProto)
+	for _, f := range fds.File {
+		byName[f.GetName()] = f
+	}
+
+	sym, err := buildSymbolTable(fds)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fds.File {
+		visible := visibleFiles(f, byName)
+		if err := resolveFile(f, sym, visible); err != nil {
+			return err
+		}
+	}
+
+	if err := checkRequiredCycles(sym); err != nil {
+		return err
+	}
+	return nil
+}
+
+// buildSymbolTable registers every message and enum in fds under its
+// fully-qualified name, and reports an error if the same name is declared
+// twice.
+func buildSymbolTable(fds *FileDescriptorSet) (map[string]*symbol, os.Error) {
+	sym := make(map[string]*symbol)
+	for _, f := range fds.File {
+		root := ""
+		if f.Package != nil {
+			root = "." + f.GetPackage()
+		}
+		for _, msg := range f.MessageType {
+			if err := registerMessage(sym, f.GetName(), root, msg); err != nil {
+				return nil, err
+			}
+		}
+		for _, enum := range f.EnumType {
+			if err := registerEnum(sym, f.GetName(), root, enum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sym, nil
+}
+
+func registerMessage(sym map[string]*symbol, file, scope string, msg *DescriptorProto) os.Error {
+	fq := scope + "." + msg.GetName()
+	if existing, ok := sym[fq]; ok {
+		return resolveErrorf("%q is defined in both %s and %s", fq, existing.file, file)
+	}
+	sym[fq] = &symbol{kind: symbolMessage, file: file, fq: fq, msg: msg}
+
+	for _, nested := range msg.NestedType {
+		if err := registerMessage(sym, file, fq, nested); err != nil {
+			return err
+		}
+	}
+	for _, enum := range msg.EnumType {
+		if err := registerEnum(sym, file, fq, enum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerEnum(sym map[string]*symbol, file, scope string, enum *EnumDescriptorProto) os.Error {
+	fq := scope + "." + enum.GetName()
+	if existing, ok := sym[fq]; ok {
+		return resolveErrorf("%q is defined in both %s and %s", fq, existing.file, file)
+	}
+	sym[fq] = &symbol{kind: symbolEnum, file: file, fq: fq, enum: enum}
+	return nil
+}
+
+// visibleFiles computes the set of file names whose top-level symbols f is
+// allowed to reference without qualification beyond scoping: f itself, its
+// direct imports, and the transitive "public" imports of those imports
+// (since a public import re-exports its own imports' symbols).
+func visibleFiles(f *FileDescriptorProto, byName map[string]*FileDescriptorProto) map[string]bool {
+	visible := map[string]bool{f.GetName(): true}
+	for _, dep := range f.Dependency {
+		addPublicClosure(dep, byName, visible)
+	}
+	return visible
+}
+
+func addPublicClosure(name string, byName map[string]*FileDescriptorProto, visible map[string]bool) {
+	if visible[name] {
+		return
+	}
+	visible[name] = true
+	dep, ok := byName[name]
+	if !ok {
+		return
+	}
+	for _, pubIdx := range dep.PublicDependency {
+		if int(pubIdx) < len(dep.Dependency) {
+			addPublicClosure(dep.Dependency[pubIdx], byName, visible)
+		}
+	}
+}
+
+// resolveFile resolves every type reference within f.
+func resolveFile(f *FileDescriptorProto, sym map[string]*symbol, visible map[string]bool) *resolveError {
+	scopes := packageScopes(f)
+
+	for _, msg := range f.MessageType {
+		if err := resolveMessage(msg, scopes, sym, visible); err != nil {
+			return err
+		}
+	}
+	for _, field := range f.Extension {
+		if err := resolveField(field, scopes, sym, visible); err != nil {
+			return err
+		}
+	}
+	for _, svc := range f.Service {
+		for _, m := range svc.Method {
+			if err := resolveTypeName(m.InputType, scopes, sym, visible); err != nil {
+				return err
+			}
+			if err := resolveTypeName(m.OutputType, scopes, sym, visible); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// packageScopes returns the sequence of scopes protoc searches when
+// resolving a type name referenced without a leading dot from a file in
+// package root: the full package, then each successively shorter prefix of
+// it (so a file in package a.b.c can reach a sibling type declared under
+// a.b or a, not just under a.b.c itself), and finally the package-less
+// root.
+func packageScopes(f *FileDescriptorProto) []string {
+	if f.Package == nil {
+		return []string{""}
+	}
+	pkg := f.GetPackage()
+	var scopes []string
+	for {
+		scopes = append(scopes, "."+pkg)
+		idx := strings.LastIndex(pkg, ".")
+		if idx < 0 {
+			break
+		}
+		pkg = pkg[:idx]
+	}
+	return append(scopes, "")
+}
+
+func resolveMessage(msg *DescriptorProto, scopes []string, sym map[string]*symbol, visible map[string]bool) *resolveError {
+	fq := scopes[0] + "." + msg.GetName()
+	inner := append([]string{fq}, scopes...)
+
+	for _, field := range msg.Field {
+		if err := resolveField(field, inner, sym, visible); err != nil {
+			return err
+		}
+	}
+	for _, field := range msg.Extension {
+		if err := resolveField(field, inner, sym, visible); err != nil {
+			return err
+		}
+	}
+	for _, nested := range msg.NestedType {
+		if err := resolveMessage(nested, inner, sym, visible); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveField(f *FieldDescriptorProto, scopes []string, sym map[string]*symbol, visible map[string]bool) *resolveError {
+	if f.Extendee != nil {
+		s, err := resolveTypeNameTo(f.GetExtendee(), scopes, sym, visible)
+		if err != nil {
+			return err
+		}
+		if s.kind != symbolMessage {
+			return resolveErrorf("%q is an extendee but does not name a message", f.GetExtendee())
+		}
+		f.Extendee = proto.String(fqNameOf(s))
+	}
+
+	if f.TypeName == nil {
+		return nil
+	}
+	s, err := resolveTypeNameTo(f.GetTypeName(), scopes, sym, visible)
+	if err != nil {
+		return err
+	}
+	f.TypeName = proto.String(fqNameOf(s))
+	switch s.kind {
+	case symbolMessage:
+		if f.Type == nil || f.GetType() != FieldDescriptorProto_TYPE_GROUP {
+			f.Type = NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE)
+		}
+	case symbolEnum:
+		f.Type = NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_ENUM)
+	}
+	return nil
+}
+
+// resolveTypeName is like resolveTypeNameTo but only used where the caller
+// doesn't need the resolved symbol back (method input/output types).
+func resolveTypeName(name *string, scopes []string, sym map[string]*symbol, visible map[string]bool) *resolveError {
+	if name == nil {
+		return nil
+	}
+	s, err := resolveTypeNameTo(*name, scopes, sym, visible)
+	if err != nil {
+		return err
+	}
+	*name = fqNameOf(s)
+	return nil
+}
+
+func resolveTypeNameTo(raw string, scopes []string, sym map[string]*symbol, visible map[string]bool) (*symbol, *resolveError) {
+	if len(raw) > 0 && raw[0] == '.' {
+		s, ok := sym[raw]
+		if !ok {
+			return nil, resolveErrorf("%q is not defined", raw)
+		}
+		if !visible[s.file] {
+			return nil, resolveErrorf("%q is defined in %s, which is not imported", raw, s.file)
+		}
+		return s, nil
+	}
+
+	for _, scope := range scopes {
+		candidate := scope + "." + raw
+		if s, ok := sym[candidate]; ok && visible[s.file] {
+			return s, nil
+		}
+	}
+	return nil, resolveErrorf("%q is not defined", raw)
+}
+
+func fqNameOf(s *symbol) string {
+	return s.fq
+}
+
+// checkRequiredCycles reports an error if any chain of required
+// singular-message fields forms a cycle, which would make it impossible to
+// ever construct a value of any message in the cycle.
+func checkRequiredCycles(sym map[string]*symbol) *resolveError {
+	const (
+		white = 0
+		gray  = 1
+		black = 2
+	)
+	color := make(map[string]int)
+
+	var visit func(name string, stack []string) *resolveError
+	visit = func(name string, stack []string) *resolveError {
+		switch color[name] {
+		case black:
+			return nil
+		case gray:
+			return resolveErrorf("required-field cycle detected: %s", cyclePath(append(stack, name)))
+		}
+		color[name] = gray
+		s := sym[name]
+		if s != nil && s.kind == symbolMessage {
+			for _, f := range s.msg.Field {
+				if !isRequiredMessageField(f) {
+					continue
+				}
+				if err := visit(f.GetTypeName(), append(stack, name)); err != nil {
+					return err
+				}
+			}
+		}
+		color[name] = black
+		return nil
+	}
+
+	for name, s := range sym {
+		if s.kind != symbolMessage {
+			continue
+		}
+		if color[name] == white {
+			if err := visit(name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isRequiredMessageField(f *FieldDescriptorProto) bool {
+	return f.Label != nil && f.GetLabel() == FieldDescriptorProto_LABEL_REQUIRED &&
+		f.Type != nil && f.GetType() == FieldDescriptorProto_TYPE_MESSAGE
+}
+
+func cyclePath(names []string) string {
+	out := ""
+	for i, n := range names {
+		if i > 0 {
+			out += " -> "
+		}
+		out += n
+	}
+	return out
+}
@@ -0,0 +1,163 @@
+package parser
+
+import (
+	"testing"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+	"goprotobuf.googlecode.com/hg/proto"
+)
+
+// TestResolveNestedPackageScope covers the 1e6ded9 fix: a file in package
+// a.b.c must be able to reach an unqualified type declared under a
+// shorter prefix of its own package (here a.b), not just under a.b.c
+// itself or the package-less root.
+func TestResolveNestedPackageScope(t *testing.T) {
+	widget := &DescriptorProto{Name: proto.String("Widget")}
+	ab := &FileDescriptorProto{
+		Name:        proto.String("ab.proto"),
+		Package:     proto.String("a.b"),
+		MessageType: []*DescriptorProto{widget},
+	}
+
+	gadget := &DescriptorProto{
+		Name: proto.String("Gadget"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:     proto.String("w"),
+				Number:   proto.Int32(1),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				TypeName: proto.String("Widget"),
+			},
+		},
+	}
+	abc := &FileDescriptorProto{
+		Name:        proto.String("abc.proto"),
+		Package:     proto.String("a.b.c"),
+		Dependency:  []string{"ab.proto"},
+		MessageType: []*DescriptorProto{gadget},
+	}
+
+	fds := &FileDescriptorSet{File: []*FileDescriptorProto{ab, abc}}
+	if err := Resolve(fds); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	f := gadget.Field[0]
+	if f.GetTypeName() != ".a.b.Widget" {
+		t.Errorf("Gadget.w type = %q, want .a.b.Widget", f.GetTypeName())
+	}
+	if f.GetType() != FieldDescriptorProto_TYPE_MESSAGE {
+		t.Errorf("Gadget.w type kind = %v, want TYPE_MESSAGE", f.GetType())
+	}
+}
+
+// TestResolvePublicImportVisibility covers transitive "public" import
+// visibility: c.proto imports b.proto only, but b.proto publicly imports
+// a.proto, so a type declared in a.proto must still be visible to
+// c.proto.
+func TestResolvePublicImportVisibility(t *testing.T) {
+	foo := &DescriptorProto{Name: proto.String("Foo")}
+	a := &FileDescriptorProto{
+		Name:        proto.String("a.proto"),
+		Package:     proto.String("p"),
+		MessageType: []*DescriptorProto{foo},
+	}
+	b := &FileDescriptorProto{
+		Name:             proto.String("b.proto"),
+		Package:          proto.String("p"),
+		Dependency:       []string{"a.proto"},
+		PublicDependency: []int32{0},
+	}
+
+	bar := &DescriptorProto{
+		Name: proto.String("Bar"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:     proto.String("foo"),
+				Number:   proto.Int32(1),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				TypeName: proto.String("Foo"),
+			},
+		},
+	}
+	c := &FileDescriptorProto{
+		Name:        proto.String("c.proto"),
+		Package:     proto.String("p"),
+		Dependency:  []string{"b.proto"},
+		MessageType: []*DescriptorProto{bar},
+	}
+
+	fds := &FileDescriptorSet{File: []*FileDescriptorProto{a, b, c}}
+	if err := Resolve(fds); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if got := bar.Field[0].GetTypeName(); got != ".p.Foo" {
+		t.Errorf("Bar.foo type = %q, want .p.Foo", got)
+	}
+}
+
+// TestResolveUnresolvedNameErrors covers the error path: a reference to a
+// type that is never declared anywhere in the set must fail Resolve
+// rather than leave the field unqualified.
+func TestResolveUnresolvedNameErrors(t *testing.T) {
+	msg := &DescriptorProto{
+		Name: proto.String("Lonely"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:     proto.String("ghost"),
+				Number:   proto.Int32(1),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_OPTIONAL),
+				TypeName: proto.String("DoesNotExist"),
+			},
+		},
+	}
+	fd := &FileDescriptorProto{
+		Name:        proto.String("lonely.proto"),
+		MessageType: []*DescriptorProto{msg},
+	}
+
+	fds := &FileDescriptorSet{File: []*FileDescriptorProto{fd}}
+	if err := Resolve(fds); err == nil {
+		t.Fatal("Resolve with an undefined type reference: got no error, want one")
+	}
+}
+
+// TestResolveRequiredFieldCycle covers checkRequiredCycles: two messages
+// with required message-typed fields pointing at each other can never be
+// constructed, so Resolve must reject them.
+func TestResolveRequiredFieldCycle(t *testing.T) {
+	a := &DescriptorProto{
+		Name: proto.String("A"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:     proto.String("b"),
+				Number:   proto.Int32(1),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_REQUIRED),
+				Type:     NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE),
+				TypeName: proto.String("B"),
+			},
+		},
+	}
+	b := &DescriptorProto{
+		Name: proto.String("B"),
+		Field: []*FieldDescriptorProto{
+			{
+				Name:     proto.String("a"),
+				Number:   proto.Int32(1),
+				Label:    NewFieldDescriptorProto_Label(FieldDescriptorProto_LABEL_REQUIRED),
+				Type:     NewFieldDescriptorProto_Type(FieldDescriptorProto_TYPE_MESSAGE),
+				TypeName: proto.String("A"),
+			},
+		},
+	}
+	fd := &FileDescriptorProto{
+		Name:        proto.String("cycle.proto"),
+		MessageType: []*DescriptorProto{a, b},
+	}
+
+	fds := &FileDescriptorSet{File: []*FileDescriptorProto{fd}}
+	if err := Resolve(fds); err == nil {
+		t.Fatal("Resolve with a required-field cycle: got no error, want one")
+	}
+}
@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"strings"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+	"goprotobuf.googlecode.com/hg/proto"
+)
+
+// Field numbers from descriptor.proto, used to build SourceCodeInfo paths.
+// See google/protobuf/descriptor.proto for the canonical list.
+const (
+	fileMessageTypeField = 4
+	fileEnumTypeField    = 5
+	fileServiceField     = 6
+
+	messageFieldField      = 2
+	messageNestedTypeField = 3
+	messageEnumTypeField   = 4
+	messageOneofDeclField  = 8
+
+	enumValueField = 2
+
+	serviceMethodField = 2
+)
+
+// leadComments holds the comments a construct's first token claimed while
+// being tokenized (see parser.claimComments); it travels down into the
+// read* call that builds that construct's descriptor and Location.
+type leadComments struct {
+	leading  string
+	detached []string
+}
+
+func (t *token) comments() leadComments {
+	return leadComments{leading: t.leadingComments, detached: t.detachedComments}
+}
+
+// startLocation begins a SourceCodeInfo_Location for the descriptor that
+// will live at path within p.fd, anchored at start's position.
+func (p *parser) startLocation(path []int32, start *token, lc leadComments) *locBuilder {
+	return &locBuilder{
+		path:      append([]int32(nil), path...),
+		startLine: start.line,
+		startCol:  start.col,
+		leading:   lc.leading,
+		detached:  lc.detached,
+	}
+}
+
+type locBuilder struct {
+	path      []int32
+	startLine int
+	startCol  int
+	leading   string
+	detached  []string
+}
+
+// finish records the Location, using end's end-position as the location's
+// closing span, and attempts to pick up a same-line trailing comment (e.g.
+// "name = 1; // trailing").
+func (lb *locBuilder) finish(p *parser, end *token) {
+	if lb == nil || p.fd == nil {
+		return
+	}
+	if p.fd.SourceCodeInfo == nil {
+		p.fd.SourceCodeInfo = new(SourceCodeInfo)
+	}
+	loc := &SourceCodeInfo_Location{
+		Path: lb.path,
+		Span: spanOf(lb.startLine, lb.startCol, end.endLine, end.endCol),
+	}
+	if lb.leading != "" {
+		loc.LeadingComments = proto.String(lb.leading)
+	}
+	for _, d := range lb.detached {
+		loc.LeadingDetachedComments = append(loc.LeadingDetachedComments, d)
+	}
+	if trailing := p.takeTrailingComment(end.endLine); trailing != "" {
+		loc.TrailingComments = proto.String(trailing)
+	}
+	p.fd.SourceCodeInfo.Location = append(p.fd.SourceCodeInfo.Location, loc)
+}
+
+// spanOf builds the 3- or 4-element Span protoc emits: [line, col, endCol]
+// when the location fits on one line, else [line, col, endLine, endCol].
+func spanOf(startLine, startCol, endLine, endCol int) []int32 {
+	if startLine == endLine {
+		return []int32{int32(startLine - 1), int32(startCol), int32(endCol)}
+	}
+	return []int32{int32(startLine - 1), int32(startCol), int32(endLine - 1), int32(endCol)}
+}
+
+// takeTrailingComment looks for a "// ..." or "/* ... */" comment that
+// starts on afterLine, immediately following (modulo horizontal whitespace)
+// the token that just finished there, without consuming anything if none is
+// found. It does not advance the tokenizer's notion of "current token".
+func (p *parser) takeTrailingComment(afterLine int) string {
+	i := 0
+	for i < len(p.s) && (p.s[i] == ' ' || p.s[i] == '\t' || p.s[i] == '\r') {
+		i++
+	}
+	if i+1 >= len(p.s) || p.s[i] != '/' {
+		return ""
+	}
+	var text string
+	var consumed int
+	switch p.s[i+1] {
+	case '/':
+		start := i + 2
+		j := start
+		for j < len(p.s) && p.s[j] != '\n' {
+			j++
+		}
+		text = strings.TrimSpace(p.s[start:j])
+		consumed = j
+	case '*':
+		start := i + 2
+		end := start
+		base := p.offset
+		for end+1 < len(p.s) && !(p.s[end] == '*' && p.s[end+1] == '/') {
+			if p.s[end] == '\n' {
+				p.line++
+				p.lineStart = base + end + 1
+			}
+			end++
+		}
+		if end+1 >= len(p.s) {
+			return ""
+		}
+		text = strings.TrimSpace(p.s[start:end])
+		consumed = end + 2
+	default:
+		return ""
+	}
+
+	p.offset += consumed
+	p.s = p.s[consumed:]
+	return text
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"testing"
+
+	. "goprotobuf.googlecode.com/hg/compiler/descriptor"
+)
+
+// TestSourceCodeInfoComments covers chunk0-4: leading comments attached to
+// a message and one of its fields must show up in the parsed file's
+// SourceCodeInfo, keyed by the same descriptor.proto field-number path
+// protoc itself uses.
+func TestSourceCodeInfoComments(t *testing.T) {
+	fd := parseGolden(t)
+
+	if fd.SourceCodeInfo == nil {
+		t.Fatal("SourceCodeInfo is nil")
+	}
+
+	msgLoc := findLocation(fd, []int32{fileMessageTypeField, 0})
+	if msgLoc == nil {
+		t.Fatal("no Location for message Shape")
+	}
+	if got := msgLoc.GetLeadingComments(); got != "Shape is a simple named, colored shape." {
+		t.Errorf("Shape leading comment = %q", got)
+	}
+
+	enumLoc := findLocation(fd, []int32{fileEnumTypeField, 0})
+	if enumLoc == nil {
+		t.Fatal("no Location for enum Color")
+	}
+	if got := enumLoc.GetLeadingComments(); got != "Color enumerates the colors a Shape can have." {
+		t.Errorf("Color leading comment = %q", got)
+	}
+
+	// The "name" field is Shape's field 0.
+	nameLoc := findLocation(fd, []int32{fileMessageTypeField, 0, messageFieldField, 0})
+	if nameLoc == nil {
+		t.Fatal("no Location for Shape.name")
+	}
+	if nameLoc.Span == nil || len(nameLoc.Span) < 3 {
+		t.Errorf("Shape.name span = %v, want a populated [start_line, start_col, end_col]", nameLoc.Span)
+	}
+}
+
+func findLocation(fd *FileDescriptorProto, path []int32) *SourceCodeInfo_Location {
+	for _, loc := range fd.SourceCodeInfo.Location {
+		if pathEqual(loc.Path, path) {
+			return loc
+		}
+	}
+	return nil
+}
+
+func pathEqual(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}